@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Where captured input is passed through to, see [CaptureConfig.tee].
+const (
+	TEE_STDOUT string = "stdout"
+	TEE_STDERR string = "stderr"
+)
+
+func validateTee(tee string) error {
+	switch tee {
+	case "", TEE_STDOUT, TEE_STDERR:
+		return nil
+	}
+	return fmt.Errorf("unknown tee output %q: must be empty, %q or %q", tee, TEE_STDOUT, TEE_STDERR)
+}
+
+// Size of the buffer producers sharing a capture file are read with.
+// Longer lines are captured in several writes, which may interleave
+// with the lines of other producers.
+const LINE_BUFFER_SIZE int = 64 << 10
+
+// Wraps errors returned by the writer given to [copyLines],
+// telling them apart from read errors.
+type WriteError struct {
+	err error
+}
+
+func (e *WriteError) Error() string { return "write error: " + e.err.Error() }
+func (e *WriteError) Unwrap() error { return e.err }
+
+// Copies r into w a line at a time, so that producers sharing a capture file
+// don't interleave within lines. Returns nil on EOF.
+func copyLines(r *bufio.Reader, w io.Writer) error {
+	for {
+		line, err := r.ReadSlice('\n')
+		if len(line) > 0 {
+			if _, werr := w.Write(line); werr != nil {
+				return &WriteError{werr}
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Returned by writes to a [CaptureWriter] after it was closed.
+var errCaptureClosed = errors.New("capture file closed")
+
+// A capture file that can be closed while input is still being copied into it.
+// Writes are serialized, and fail once the file is closed.
+type CaptureWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closed bool
+}
+
+func (cw *CaptureWriter) Write(p []byte) (int, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.closed {
+		return 0, errCaptureClosed
+	}
+	return cw.w.Write(p)
+}
+
+// Flushes and closes the file. Safe to call more than once.
+func (cw *CaptureWriter) Close() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+	if f, ok := cw.w.(*os.File); ok {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return fmt.Errorf("sync capture file: %w", err)
+		}
+	}
+	if c, ok := cw.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Passes input through to out, as is, before writing it to w.
+//
+// Input is still captured if out fails, say because the next program in a pipeline exited.
+type TeeWriter struct {
+	w      io.Writer
+	out    io.Writer
+	failed bool
+}
+
+func (t *TeeWriter) Write(p []byte) (int, error) {
+	if !t.failed {
+		if _, err := t.out.Write(p); err != nil {
+			t.failed = true
+			log.Printf("Tee output failed, capturing only: %+v", err)
+		}
+	}
+	return t.w.Write(p)
+}
+
+// Wraps w to pass input through to the output named by tee, if any.
+func newTeeWriter(w io.Writer, tee string) io.Writer {
+	switch tee {
+	case TEE_STDOUT:
+		return &TeeWriter{w: w, out: os.Stdout}
+	case TEE_STDERR:
+		return &TeeWriter{w: w, out: os.Stderr}
+	}
+	return w
+}
+
+// Opens the capture file called name, for the capture id, which is also
+// the name of the file unless a capture writes several of them.
+// mode is added to the flags of plain files, rolling files are always appended to.
+func openCapture(g *Globals, id string, name string, mode int) (*CaptureWriter, error) {
+	path := capturePathOf(g, id, name)
+	if g.rolling {
+		return &CaptureWriter{w: getRollingLogger(path, g.rollingOptions(), false)}, nil
+	}
+	log.Printf("Creating capture file: %q", path)
+	// Only created upfront by commands that always capture.
+	if err := os.MkdirAll(g.capturePath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create capture directory: %+v", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|mode, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capture file: %+v", err)
+	}
+	return &CaptureWriter{w: f}, nil
+}
+
+// Returns the path of the capture file opened by [openCapture].
+func capturePathOf(g *Globals, id string, name string) string {
+	if g.rolling {
+		return filepath.Join(g.capturePath, id, name+".log")
+	}
+	return filepath.Join(g.capturePath, name+".log")
+}
+
+// Copies STDIN into the capture file until EOF or a shutdown request.
+//
+// On shutdown, input is still copied for up to [BaseConfig.shutdownTimeout],
+// since the process writing it is likely stopping too and may have output left.
+func startCapture(g *Globals) (err error) {
+	log.Printf("Starting capture mode. Capture id: \"%s\". Home path: \"%s\". Capture path: \"%s\"", g.captureId, g.homePath, g.capturePath)
+	if g.listen != "" {
+		return listenCaptures(g)
+	}
+	cw, err := openCapture(g, g.captureId, g.captureId, os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if g.tee != "" {
+		// Broken pipes must not kill the process before the capture file is closed.
+		signal.Ignore(syscall.SIGPIPE)
+	}
+	w := newTeeWriter(newLinePrefixer(cw, &g.CaptureConfig, new(atomic.Uint64), ""), g.tee)
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(w, os.Stdin)
+		copied <- err
+	}()
+	select {
+	case err = <-copied:
+	case <-g.shutdown:
+		log.Print("Shutting down, waiting for the end of input.")
+		ctx, cancel := g.shutdownContext()
+		defer cancel()
+		select {
+		case err = <-copied:
+		case <-ctx.Done():
+			log.Print("Input still open, closing the capture file.")
+		}
+	}
+	if cerr := cw.Close(); cerr != nil && err == nil {
+		err = fmt.Errorf("close capture file: %w", cerr)
+	}
+	return err
+}
+
+// Most capture files a [CaptureFiles] keeps open at once. Beyond it, the least
+// recently used file no producer is writing to is closed to make room.
+const MAX_OPEN_CAPTURES int = 256
+
+// Returned by [CaptureFiles.get] when every open file is in use.
+var errTooManyCaptures = fmt.Errorf("too many capture files in use, at most %d", MAX_OPEN_CAPTURES)
+
+// Capture files opened on demand by capture id, and shared by every
+// producer writing to the same id, as with network ingest. Files are
+// appended to, and kept open while in use, up to [MAX_OPEN_CAPTURES],
+// until [CaptureFiles.Close].
+type CaptureFiles struct {
+	g     *Globals
+	mu    sync.Mutex
+	files map[string]*CaptureFile
+	// Counts releases, ordering idle files by last use.
+	clock  uint64
+	closed bool
+}
+
+type CaptureFile struct {
+	id string
+	w  *CaptureWriter
+	// Numbers the lines of every producer, see [CaptureConfig.sequence].
+	// Starts over if the file is closed while idle and opened again.
+	seq atomic.Uint64
+	// Producers holding the file, and when it was last released.
+	refs     int
+	released uint64
+}
+
+func newCaptureFiles(g *Globals) *CaptureFiles {
+	return &CaptureFiles{g: g, files: make(map[string]*CaptureFile)}
+}
+
+// Returns the capture file of id, opening it if needed.
+// Every call must be paired with a call to [CaptureFiles.release].
+func (cf *CaptureFiles) get(id string) (*CaptureFile, error) {
+	if err := validateCaptureId(id); err != nil {
+		return nil, err
+	}
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if cf.closed {
+		return nil, errCaptureClosed
+	}
+	if f, ok := cf.files[id]; ok {
+		f.refs++
+		return f, nil
+	}
+	if len(cf.files) >= MAX_OPEN_CAPTURES && !cf.closeIdle() {
+		return nil, errTooManyCaptures
+	}
+	w, err := openCapture(cf.g, id, id, os.O_APPEND)
+	if err != nil {
+		return nil, err
+	}
+	f := &CaptureFile{id: id, w: w, refs: 1}
+	cf.files[id] = f
+	return f, nil
+}
+
+// Lets go of a file returned by [CaptureFiles.get].
+func (cf *CaptureFiles) release(f *CaptureFile) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	f.refs--
+	cf.clock++
+	f.released = cf.clock
+}
+
+// Closes the least recently used file not in use, if any. Called with mu held.
+func (cf *CaptureFiles) closeIdle() bool {
+	var lru *CaptureFile
+	for _, f := range cf.files {
+		if f.refs == 0 && (lru == nil || f.released < lru.released) {
+			lru = f
+		}
+	}
+	if lru == nil {
+		return false
+	}
+	delete(cf.files, lru.id)
+	if err := lru.w.Close(); err != nil {
+		log.Printf("Failed to close capture file %q: %+v", lru.id, err)
+	}
+	return true
+}
+
+// Closes every file. Later calls to [CaptureFiles.get] fail.
+func (cf *CaptureFiles) Close() (err error) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	cf.closed = true
+	for id, f := range cf.files {
+		if cerr := f.w.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("close capture file %q: %w", id, cerr)
+		}
+	}
+	return err
+}
+
+// Returns a writer for a single producer, prefixing its lines
+// as set by [CaptureConfig], and tagging them with tag if not empty.
+func (f *CaptureFile) writer(c *CaptureConfig, tag string) io.Writer {
+	return newLinePrefixer(f.w, c, &f.seq, tag)
+}
+
+// Capture ids become file and directory names, and may come from the network.
+var captureIdRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,127}$`)
+
+func validateCaptureId(id string) error {
+	if !captureIdRegexp.MatchString(id) {
+		return fmt.Errorf("invalid capture id %q: must be up to 128 letters, digits, '.', '_' or '-', not starting with '.' or '-'", id)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCaptureFilesLimit(t *testing.T) {
+	g := &Globals{GlobalConfig: &GlobalConfig{}}
+	g.capturePath = t.TempDir()
+	cf := newCaptureFiles(g)
+	defer cf.Close()
+
+	files := make([]*CaptureFile, MAX_OPEN_CAPTURES)
+	for i := range files {
+		f, err := cf.get(fmt.Sprint(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[i] = f
+	}
+	if _, err := cf.get("extra"); !errors.Is(err, errTooManyCaptures) {
+		t.Fatalf("error %v with every file in use, want %v", err, errTooManyCaptures)
+	}
+
+	// Released in order, leaving 1 as the least recently used.
+	cf.release(files[1])
+	cf.release(files[2])
+	extra, err := cf.get("extra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cf.release(extra)
+	if _, err := files[1].w.Write([]byte("x\n")); !errors.Is(err, errCaptureClosed) {
+		t.Errorf("error %v writing to the closed file, want %v", err, errCaptureClosed)
+	}
+	if _, err := files[2].w.Write([]byte("x\n")); err != nil {
+		t.Errorf("idle file closed out of order: %v", err)
+	}
+	if len(cf.files) != MAX_OPEN_CAPTURES {
+		t.Errorf("%d files open, want %d", len(cf.files), MAX_OPEN_CAPTURES)
+	}
+
+	// Opened again, closing 2 rather than 0, released after it.
+	cf.release(files[0])
+	f, err := cf.get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cf.release(f)
+	if _, err := f.w.Write([]byte("y\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cf.files["0"]; !ok {
+		t.Error("file 0 closed before file 2")
+	}
+	for name, want := range map[string]string{"1.log": "y\n", "2.log": "x\n"} {
+		b, err := os.ReadFile(filepath.Join(g.capturePath, name))
+		if err != nil || string(b) != want {
+			t.Errorf("%s: %q, %v, want %q", name, b, err, want)
+		}
+	}
+}
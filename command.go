@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	COMMAND_SERVE   string = "serve"
+	COMMAND_CAPTURE string = "capture"
+	COMMAND_RUN     string = "run"
+	COMMAND_INGEST  string = "ingest"
+	COMMAND_DEMO    string = "demo"
+	COMMAND_HELP    string = "help"
+	// Run when the first argument is a flag or there are none,
+	// as in versions of Logyard that predate commands.
+	DEFAULT_COMMAND string = COMMAND_SERVE
+)
+
+// A subcommand, the first argument given to Logyard.
+type Command struct {
+	name string
+	// A one-line description, listed by "logyard help".
+	summary string
+	// A longer description, shown above the flags of the command.
+	description string
+	// Registers the flags of the command, on top of [GlobalConfig.baseFlags]. Optional.
+	flags func(c *GlobalConfig, fs *flag.FlagSet)
+	// Describes the positional arguments taken after the flags, for the usage.
+	// Empty if the command takes none. See [BaseConfig.args].
+	args string
+	run  func(g *Globals) error
+}
+
+// Returned once the usage was printed for invalid flags.
+var errInvalidFlags = errors.New("invalid flags")
+
+// Every command but [COMMAND_HELP], which lists them. A function rather than
+// a variable, since commands reload their own configuration and would
+// otherwise refer to the list during its initialization.
+func commands() []Command {
+	return []Command{
+		{
+			name:    COMMAND_SERVE,
+			summary: "Serve log files through a web UI. The default command.",
+			description: "Starts a lightweight server listing all *.log files found in the source paths. " +
+				"Each file can then be streamed through WebSockets.",
+			flags: (*GlobalConfig).serverFlags,
+			run:   startServer,
+		},
+		{
+			name:        COMMAND_CAPTURE,
+			summary:     "Write STDIN into a log file.",
+			description: "Dumps any input received through STDIN into a log file under -cdir, named after -id.",
+			flags:       (*GlobalConfig).captureFlags,
+			run:         startCapture,
+		},
+		{
+			name:    COMMAND_RUN,
+			summary: "Run a command, capturing its output.",
+			description: "Runs a command, capturing its standard output and error into log files under -cdir, named after -id. " +
+				"Signals are forwarded to the command, which may be restarted when it exits. " +
+				"Starts and exits are recorded in the capture files.",
+			flags: (*GlobalConfig).superviseFlags,
+			args:  "[--] <command> [args...]",
+			run:   startSupervisor,
+		},
+		{
+			name:    COMMAND_INGEST,
+			summary: "Receive logs over the network into log files.",
+			description: "Receives logs over the network, in the formats enabled by the flags below, " +
+				"and writes them into log files under -cdir, one per source.",
+			flags: (*GlobalConfig).ingestFlags,
+			run:   startIngest,
+		},
+		{
+			name:        COMMAND_DEMO,
+			summary:     "Print sample logs, simulating a real application.",
+			description: "Prints logs to STDERR, simulating a real application.",
+			flags:       (*GlobalConfig).demoFlags,
+			run:         runDemo,
+		},
+	}
+}
+
+func findCommand(name string) (*Command, bool) {
+	cmds := commands()
+	for i := range cmds {
+		if cmds[i].name == name {
+			return &cmds[i], true
+		}
+	}
+	return nil, false
+}
+
+// Returns a flag set with the flags of cmd bound to c.
+// Flags of other commands are rejected when parsing, returning an error.
+func (c *GlobalConfig) commandFlags(cmd *Command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	c.baseFlags(fs)
+	if cmd.flags != nil {
+		cmd.flags(c, fs)
+	}
+	documentEnv(fs)
+	fs.Usage = func() {
+		out := fs.Output()
+		usage := "logyard " + cmd.name + " [flags]"
+		if cmd.args != "" {
+			usage += " " + cmd.args
+		}
+		fmt.Fprintf(out, "Usage: %s\n\n%s\n\nFlags:\n", usage, cmd.description)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// Selects the command named by the first argument and parses its flags.
+// Never exits: "logyard help [command]" and -h print the usage and return
+// [flag.ErrHelp], and invalid flags print it and return [errInvalidFlags].
+func (c *GlobalConfig) parseArgs(args []string) (*flag.FlagSet, error) {
+	name := DEFAULT_COMMAND
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	} else if len(args) > 0 && isHelpFlag(args[0]) {
+		name, args = COMMAND_HELP, nil
+	}
+	if name == COMMAND_HELP {
+		return nil, c.help(args)
+	}
+	cmd, ok := findCommand(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown command %q, run \"logyard %s\" for a list of commands", name, COMMAND_HELP)
+	}
+	c.command = cmd.name
+	fs := c.commandFlags(cmd)
+	if err := fs.Parse(args); errors.Is(err, flag.ErrHelp) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidFlags, err)
+	}
+	if cmd.args != "" {
+		c.args = fs.Args()
+	} else if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments for %q: %q", cmd.name, fs.Args())
+	}
+	return fs, nil
+}
+
+func isHelpFlag(arg string) bool {
+	switch arg {
+	case "-h", "-help", "--help":
+		return true
+	}
+	return false
+}
+
+// Prints the usage of the command in args, or the list of commands.
+func (c *GlobalConfig) help(args []string) error {
+	if len(args) == 0 {
+		printCommands(os.Stderr)
+		return flag.ErrHelp
+	}
+	cmd, ok := findCommand(args[0])
+	if !ok {
+		return fmt.Errorf("unknown command %q, run \"logyard %s\" for a list of commands", args[0], COMMAND_HELP)
+	}
+	c.commandFlags(cmd).Usage()
+	return flag.ErrHelp
+}
+
+func printCommands(w io.Writer) {
+	fmt.Fprintf(w, "Usage: logyard [command] [flags]\n\nCommands:\n")
+	for _, cmd := range commands() {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "  %-10s %s\n", COMMAND_HELP, "Show the flags of a command.")
+	fmt.Fprintf(w, "\nRun \"logyard %s <command>\" for the flags of a command.\n", COMMAND_HELP)
+}
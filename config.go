@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+const (
+	// Name of the configuration file looked up in the home directory.
+	CONFIG_FILE_NAME string = "logyard.json"
+	// Prefix of the environment variables mapped to options, see [ConfigKey.envName].
+	ENV_PREFIX string = "LOGYARD_"
+)
+
+// An option that can be set through the environment or the configuration file.
+//
+// Values are applied with the following precedence, highest first:
+// flags, environment variables, the configuration file, defaults.
+type ConfigKey struct {
+	// The key used in the configuration file.
+	key string
+	// The name of the flag the key maps to.
+	flag string
+	// Checks values beyond what the flag itself accepts. Optional.
+	validate func(string) error
+	// Whether the key is rejected by the configuration file,
+	// for options that decide how the file itself is found or used.
+	envOnly bool
+}
+
+// Every option, in the order they are dumped. Options of other commands
+// than the one being run are ignored, see [Command.flags].
+var configKeys = []ConfigKey{
+	{key: "homeDir", flag: "hdir", envOnly: true},
+	{key: "config", flag: "config", envOnly: true},
+	{key: "dumpConfig", flag: "dumpconfig", envOnly: true},
+	{key: "logging", flag: "l"},
+	{key: "captureLogs", flag: "cl"},
+	{key: "rolling", flag: "rl"},
+	{key: "chunkSizeMb", flag: "chunkmb"},
+	{key: "rotation", flag: "rotate", validate: validateRotation},
+	{key: "maxBackups", flag: "maxbackups"},
+	{key: "maxAgeDays", flag: "maxage"},
+	{key: "maxDiskMb", flag: "maxdiskmb"},
+	{key: "compress", flag: "compress"},
+	{key: "shutdownTimeout", flag: "shutdown"},
+	{key: "port", flag: "port"},
+	{key: "pollingInterval", flag: "polling"},
+	{key: "followMode", flag: "follow", validate: validateFollowMode},
+	{key: "sources", flag: "src"},
+	{key: "rescanInterval", flag: "rescan"},
+	{key: "batchSizeKb", flag: "batchkb"},
+	{key: "batchDelay", flag: "batchms"},
+	{key: "sendQueue", flag: "queue"},
+	{key: "slowClient", flag: "slow", validate: validateSlowClientPolicy},
+	{key: "writeTimeout", flag: "wtimeout"},
+	{key: "pingInterval", flag: "ping"},
+	{key: "push", flag: "push"},
+	{key: "captureId", flag: "id"},
+	{key: "captureDir", flag: "cdir"},
+	{key: "timestampFormat", flag: "ts", validate: validateTimestampFormat},
+	{key: "timestampZone", flag: "tz", validate: validateTimestampZone},
+	{key: "sequence", flag: "seq"},
+	{key: "tee", flag: "tee", validate: validateTee},
+	{key: "listen", flag: "listen", validate: validateCaptureListen},
+	{key: "split", flag: "split"},
+	{key: "restart", flag: "restart", validate: validateRestartPolicy},
+	{key: "restartDelay", flag: "restartms"},
+	{key: "maxRestarts", flag: "maxrestarts"},
+	{key: "syslog", flag: "syslog", validate: validateSyslogListen},
+	{key: "syslogPartition", flag: "partition", validate: validateSyslogPartition},
+	{key: "gelf", flag: "gelf", validate: validateGelfListen},
+	{key: "forward", flag: "forward", validate: validateForwardListen},
+	{key: "demoLines", flag: "lines"},
+	{key: "maxDemoInterval", flag: "maxDemoInterval"},
+}
+
+func findConfigKey(key string) (ConfigKey, bool) {
+	for _, k := range configKeys {
+		if k.key == key && !k.envOnly {
+			return k, true
+		}
+	}
+	return ConfigKey{}, false
+}
+
+// Returns the environment variable mapped to k: [ENV_PREFIX] followed
+// by the key in upper snake case, "chunkSizeMb" being "LOGYARD_CHUNK_SIZE_MB".
+func (k ConfigKey) envName() string {
+	var b strings.Builder
+	b.WriteString(ENV_PREFIX)
+	for i, r := range k.key {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// Mentions the environment variable of each option in the usage of its flag.
+func documentEnv(flags *flag.FlagSet) {
+	for _, k := range configKeys {
+		if f := flags.Lookup(k.flag); f != nil {
+			f.Usage += " Environment: " + k.envName() + "."
+		}
+	}
+}
+
+// Applies the environment variables of the options whose flags
+// were not set on the command line. Empty variables are ignored.
+//
+// Returns the names of the variables that were applied.
+func applyEnv(flags *flag.FlagSet) ([]string, error) {
+	set := setFlags(flags)
+	var applied []string
+	for _, k := range configKeys {
+		name := k.envName()
+		v := os.Getenv(name)
+		if v == "" || set[k.flag] || flags.Lookup(k.flag) == nil {
+			continue
+		}
+		if err := flags.Set(k.flag, v); err != nil {
+			return applied, fmt.Errorf("environment variable %s: invalid value %q: %w", name, v, err)
+		}
+		applied = append(applied, name)
+	}
+	return applied, nil
+}
+
+// Applies the configuration file to the flags that were not set
+// on the command line or through the environment. The file is read from [BaseConfig.configPath] if set,
+// otherwise from [CONFIG_FILE_NAME] in the home directory, if present.
+//
+// Returns the path of the file that was loaded, if any.
+func (i *Initializer) loadConfigFile(flags *flag.FlagSet) (string, error) {
+	path := i.configPath
+	if path == "" {
+		path = filepath.Join(i.homePath, CONFIG_FILE_NAME)
+	} else if p, err := resolveAbsolutePath(path, i.homePath); err != nil {
+		return "", fmt.Errorf("resolve absolute path: %w", err)
+	} else {
+		path = p
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && i.configPath == "" {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("read config file: %w", err)
+	}
+	if err := applyConfig(flags, b); err != nil {
+		return "", fmt.Errorf("config file %q: %w", path, err)
+	}
+	return path, nil
+}
+
+func applyConfig(flags *flag.FlagSet, b []byte) error {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(b, &values); err != nil {
+		return fmt.Errorf("malformed config: %w", err)
+	}
+	set := setFlags(flags)
+	for key, raw := range values {
+		k, ok := findConfigKey(key)
+		if !ok {
+			return fmt.Errorf("unknown key %q", key)
+		}
+		if set[k.flag] || flags.Lookup(k.flag) == nil {
+			continue
+		}
+		_, isString := flags.Lookup(k.flag).Value.(flag.Getter).Get().(string)
+		v, err := configValue(raw, isString)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", key, err)
+		}
+		if err := flags.Set(k.flag, v); err != nil {
+			return fmt.Errorf("key %q: invalid value %q: %w", key, v, err)
+		}
+	}
+	return nil
+}
+
+// Returns the names of the flags set on the command line.
+func setFlags(flags *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// Converts a JSON value into a string accepted by [flag.Value.Set].
+// Arrays of strings are joined with commas, as in -src.
+// String flags only take strings and arrays of strings.
+func configValue(raw json.RawMessage, isString bool) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return "", fmt.Errorf("empty value")
+	}
+	switch raw[0] {
+	case '"':
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	case '[':
+		var list []string
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return "", fmt.Errorf("expected a list of strings: %w", err)
+		}
+		return strings.Join(list, ","), nil
+	case '{':
+		return "", fmt.Errorf("unexpected object")
+	case 'n':
+		return "", fmt.Errorf("unexpected null")
+	}
+	if isString {
+		return "", fmt.Errorf("expected a string, got %s", raw)
+	}
+	// Numbers and booleans are parsed by the flag itself.
+	return string(raw), nil
+}
+
+// Checks the effective value of every option with a validator.
+// Errors name both the key and the flag, since either may be the culprit.
+func validateConfig(flags *flag.FlagSet) error {
+	for _, k := range configKeys {
+		f := flags.Lookup(k.flag)
+		if f == nil || k.validate == nil {
+			continue
+		}
+		if err := k.validate(f.Value.String()); err != nil {
+			return fmt.Errorf("invalid %q (-%s): %w", k.key, k.flag, err)
+		}
+	}
+	return nil
+}
+
+// Encodes the effective value of every option as a configuration file.
+func dumpConfig(flags *flag.FlagSet) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for _, k := range configKeys {
+		f := flags.Lookup(k.flag)
+		if f == nil || k.envOnly {
+			continue
+		}
+		var v any = f.Value.String()
+		if g, ok := f.Value.(flag.Getter); ok {
+			v = g.Get()
+		}
+		key, _ := json.Marshal(k.key)
+		value, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.key, err)
+		}
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	var out bytes.Buffer
+	if err := json.Indent(&out, b.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
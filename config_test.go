@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Returns the flags of the serve command, bound to a new config.
+func serveFlags(t *testing.T) (*GlobalConfig, *flag.FlagSet) {
+	t.Helper()
+	cmd, ok := findCommand(COMMAND_SERVE)
+	if !ok {
+		t.Fatal("no serve command")
+	}
+	c := &GlobalConfig{}
+	return c, c.commandFlags(cmd)
+}
+
+func TestCommandFlags(t *testing.T) {
+	for _, tt := range []struct {
+		command string
+		// Whether it writes capture files, taking -cdir, -id and the rolling flags.
+		captures bool
+	}{
+		{COMMAND_SERVE, true},
+		{COMMAND_CAPTURE, true},
+		{COMMAND_RUN, true},
+		{COMMAND_INGEST, true},
+		{COMMAND_DEMO, false},
+	} {
+		cmd, ok := findCommand(tt.command)
+		if !ok {
+			t.Fatalf("no %s command", tt.command)
+		}
+		fs := (&GlobalConfig{}).commandFlags(cmd)
+		for _, name := range []string{"cl", "cdir", "id", "rl", "chunkmb", "rotate", "maxbackups", "maxage", "maxdiskmb", "compress"} {
+			if got := fs.Lookup(name) != nil; got != tt.captures {
+				t.Errorf("%s has -%s: %t, want %t", tt.command, name, got, tt.captures)
+			}
+		}
+		for _, name := range []string{"hdir", "l", "config", "dumpconfig", "shutdown"} {
+			if fs.Lookup(name) == nil {
+				t.Errorf("%s is missing -%s", tt.command, name)
+			}
+		}
+	}
+}
+
+func TestConfigKeyEnvName(t *testing.T) {
+	for key, want := range map[string]string{
+		"port":            "LOGYARD_PORT",
+		"chunkSizeMb":     "LOGYARD_CHUNK_SIZE_MB",
+		"maxDemoInterval": "LOGYARD_MAX_DEMO_INTERVAL",
+	} {
+		if got := (ConfigKey{key: key}).envName(); got != want {
+			t.Errorf("envName of %q = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	c, fs := serveFlags(t)
+	err := applyConfig(fs, []byte(`{"port": 9000, "sources": ["/a", "/b"], "logging": true, "followMode": "polling", "captureLogs": false}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.port != 9000 || c.sourcePaths != "/a,/b" || !c.logging || c.followMode != "polling" || c.captureLogs {
+		t.Errorf("got port %d, sources %q, logging %t, follow %q, captureLogs %t", c.port, c.sourcePaths, c.logging, c.followMode, c.captureLogs)
+	}
+	// Keys of other commands are accepted and ignored.
+	if err := applyConfig(fs, []byte(`{"tee": "stdout"}`)); err != nil || c.tee != "" {
+		t.Errorf("tee %q, %v", c.tee, err)
+	}
+}
+
+func TestApplyConfigInvalid(t *testing.T) {
+	for _, in := range []string{
+		`[]`,
+		`{"port": 1`,
+		`{"unknown": 1}`,
+		// Only taken from the environment.
+		`{"homeDir": "/tmp"}`,
+		`{"config": "other.json"}`,
+		`{"port": 1.5}`,
+		`{"port": null}`,
+		`{"sources": 1}`,
+		`{"sources": {"a": 1}}`,
+		`{"sources": [1, 2]}`,
+		`{"logging": "yes"}`,
+	} {
+		_, fs := serveFlags(t)
+		if err := applyConfig(fs, []byte(in)); err == nil {
+			t.Errorf("applyConfig(%s) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	c, fs := serveFlags(t)
+	if err := fs.Parse([]string{"-port", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LOGYARD_PORT", "2")
+	t.Setenv("LOGYARD_POLLING_INTERVAL", "2")
+	t.Setenv("LOGYARD_RESCAN_INTERVAL", "")
+	applied, err := applyEnv(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 || applied[0] != "LOGYARD_POLLING_INTERVAL" {
+		t.Errorf("applied %q, want only LOGYARD_POLLING_INTERVAL", applied)
+	}
+	if err := applyConfig(fs, []byte(`{"port": 3, "pollingInterval": 3, "rescanInterval": 3}`)); err != nil {
+		t.Fatal(err)
+	}
+	if c.port != 1 || c.pollingInterval != 2 || c.rescanInterval != 3 || c.batchDelay != 20 {
+		t.Errorf("got port %d, polling %d, rescan %d, batch delay %d, want 1, 2, 3 and the default 20",
+			c.port, c.pollingInterval, c.rescanInterval, c.batchDelay)
+	}
+}
+
+func TestApplyEnvInvalid(t *testing.T) {
+	_, fs := serveFlags(t)
+	t.Setenv("LOGYARD_PORT", "eighty")
+	if _, err := applyEnv(fs); err == nil || !strings.Contains(err.Error(), "LOGYARD_PORT") {
+		t.Errorf("error %v, want one naming LOGYARD_PORT", err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	_, fs := serveFlags(t)
+	if err := validateConfig(fs); err != nil {
+		t.Fatalf("defaults: %v", err)
+	}
+	if err := applyConfig(fs, []byte(`{"followMode": "sometimes"}`)); err != nil {
+		t.Fatal(err)
+	}
+	err := validateConfig(fs)
+	if err == nil || !strings.Contains(err.Error(), `"followMode" (-follow)`) {
+		t.Errorf("error %v, want one naming followMode and -follow", err)
+	}
+}
+
+func TestDumpConfig(t *testing.T) {
+	_, fs := serveFlags(t)
+	if err := fs.Parse([]string{"-port", "9000", "-src", "/a,/b", "-l"}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := dumpConfig(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"port": 9000`, `"sources": "/a,/b"`, `"logging": true`} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("dump is missing %s:\n%s", want, b)
+		}
+	}
+	// Options that decide how the file is found are left out.
+	if strings.Contains(string(b), "homeDir") || strings.Contains(string(b), "dumpConfig") {
+		t.Errorf("dump has environment-only options:\n%s", b)
+	}
+	// Loaded back, the dump sets the same values.
+	c, loaded := serveFlags(t)
+	if err := applyConfig(loaded, b); err != nil {
+		t.Fatal(err)
+	}
+	if c.port != 9000 || c.sourcePaths != "/a,/b" || !c.logging {
+		t.Errorf("loaded port %d, sources %q, logging %t", c.port, c.sourcePaths, c.logging)
+	}
+	again, err := dumpConfig(loaded)
+	if err != nil || string(again) != string(b) {
+		t.Errorf("dumped again as:\n%s\n%v", again, err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, CONFIG_FILE_NAME), []byte(`{"logging": true, "port": 9000}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var i Initializer
+	if _, err := i.loadConfig([]string{"serve", "-hdir", dir, "-port", "9001"}); err != nil {
+		t.Fatal(err)
+	}
+	if !i.logging || i.port != 9001 {
+		t.Errorf("got logging %t, port %d, want true and 9001", i.logging, i.port)
+	}
+
+	// Missing only when looked up in the home directory.
+	var missing Initializer
+	if _, err := missing.loadConfig([]string{"serve", "-hdir", t.TempDir()}); err != nil {
+		t.Error(err)
+	}
+	t.Setenv("LOGYARD_CONFIG", filepath.Join(dir, "missing.json"))
+	var named Initializer
+	if _, err := named.loadConfig([]string{"serve", "-hdir", dir}); err == nil {
+		t.Error("no error with a missing -config file")
+	}
+
+	// Returned rather than exiting, so that reloads can't stop the server.
+	var invalid Initializer
+	if _, err := invalid.loadConfig([]string{"demo", "-cdir", dir}); !errors.Is(err, errInvalidFlags) {
+		t.Errorf("error %v, want %v", err, errInvalidFlags)
+	}
+}
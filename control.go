@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Control message types, sent by the client.
+const (
+	CONTROL_FILTER string = "filter"
+	CONTROL_PAUSE  string = "pause"
+	CONTROL_RESUME string = "resume"
+	// Moves the stream to the position given by the same fields as [StartRequest].
+	CONTROL_SEEK string = "seek"
+	// Reopens the source and continues from the last line read,
+	// answered with the current offset and size of the source.
+	CONTROL_RESYNC string = "resync"
+)
+
+// Control frame types, sent by the server.
+const (
+	FRAME_ACK    string = "ack"
+	FRAME_ERROR  string = "error"
+	FRAME_MARKER string = "marker"
+)
+
+// Events reported by [FRAME_MARKER] frames.
+const (
+	MARKER_ROTATED   string = "rotated"
+	MARKER_TRUNCATED string = "truncated"
+	MARKER_MISSING   string = "missing"
+	// A resume cursor didn't match the source anymore.
+	MARKER_RESUME_FAILED string = "resume-failed"
+	// Lines were skipped because the client fell behind, see [SLOW_CLIENT_DROP].
+	MARKER_DROPPED string = "dropped"
+)
+
+// Starts every control frame, so clients can tell them apart from log lines.
+// This is the ASCII record separator, as used by JSON text sequences (RFC 7464).
+const CONTROL_FRAME_PREFIX byte = 0x1e
+
+// A message sent by the client over a stream's WebSocket, as JSON text.
+// [ControlMessage.Type] selects which of the other fields apply.
+type ControlMessage struct {
+	Type string `json:"type"`
+	// Optional, echoed back by the frames answering this message.
+	ID string `json:"id,omitempty"`
+	// Filter: only lines matching any of these are sent. Empty matches everything.
+	Include []string `json:"include,omitempty"`
+	// Filter: lines matching any of these are never sent.
+	Exclude []string `json:"exclude,omitempty"`
+	// Filter: whether patterns are regular expressions instead of substrings.
+	Regex bool `json:"regex,omitempty"`
+	// Filter: whether patterns are matched regardless of case.
+	IgnoreCase bool `json:"ignoreCase,omitempty"`
+	// Seek: at most one of these, see [StartRequest].
+	Tail   *int   `json:"tail,omitempty"`
+	Offset *int64 `json:"offset,omitempty"`
+	Time   string `json:"time,omitempty"`
+	From   string `json:"from,omitempty"`
+	// Set when the message could not be decoded.
+	err error
+}
+
+// A message sent by the server over a stream's WebSocket, as JSON text
+// prefixed by [CONTROL_FRAME_PREFIX].
+type ControlFrame struct {
+	Type string `json:"type"`
+	// The type and id of the control message this frame answers, if any.
+	Command string `json:"command,omitempty"`
+	ID      string `json:"id,omitempty"`
+	// Offset within the source where the stream stands.
+	Offset *int64 `json:"offset,omitempty"`
+	// Size of the source, for resyncs.
+	Size *int64 `json:"size,omitempty"`
+	// Marker: what happened to the source.
+	Event   string `json:"event,omitempty"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func ackFrame(m ControlMessage, offset int64) ControlFrame {
+	return ControlFrame{
+		Type:    FRAME_ACK,
+		Command: m.Type,
+		ID:      m.ID,
+		Offset:  &offset,
+	}
+}
+
+func errorFrame(m ControlMessage, err error) ControlFrame {
+	return ControlFrame{
+		Type:    FRAME_ERROR,
+		Command: m.Type,
+		ID:      m.ID,
+		Error:   err.Error(),
+	}
+}
+
+// Converts the fields of a [CONTROL_SEEK] message into a [StartRequest].
+func (m ControlMessage) startRequest() (StartRequest, error) {
+	q := url.Values{}
+	if m.Tail != nil {
+		q.Set("tail", strconv.Itoa(*m.Tail))
+	}
+	if m.Offset != nil {
+		q.Set("offset", strconv.FormatInt(*m.Offset, 10))
+	}
+	if m.Time != "" {
+		q.Set("time", m.Time)
+	}
+	if m.From != "" {
+		q.Set("from", m.From)
+	}
+	return parseStartRequest(q)
+}
+
+// Converts the "include", "exclude", "regex" and "ignoreCase" query parameters
+// of a stream, named after the fields of a [CONTROL_FILTER] message, into a filter
+// applied from the first line. Patterns may be repeated.
+//
+// Clients reconnecting with a resume cursor use them, since lines could
+// otherwise be sent unfiltered until their filter message arrives.
+func parseFilterQuery(q url.Values) (*LineFilter, error) {
+	m := ControlMessage{Type: CONTROL_FILTER, Include: q["include"], Exclude: q["exclude"]}
+	for name, v := range map[string]*bool{"regex": &m.Regex, "ignoreCase": &m.IgnoreCase} {
+		if s := q.Get(name); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: must be a boolean", name, s)
+			}
+			*v = b
+		}
+	}
+	lf, err := newLineFilter(m)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter: %w", err)
+	}
+	return lf, nil
+}
+
+// Selects which lines of a stream are sent to the client.
+// A nil *LineFilter matches every line.
+type LineFilter struct {
+	include []func([]byte) bool
+	exclude []func([]byte) bool
+}
+
+func newLineFilter(m ControlMessage) (*LineFilter, error) {
+	if len(m.Include) == 0 && len(m.Exclude) == 0 {
+		return nil, nil
+	}
+	var lf LineFilter
+	var err error
+	if lf.include, err = compilePatterns(m.Include, m.Regex, m.IgnoreCase); err != nil {
+		return nil, fmt.Errorf("include: %w", err)
+	}
+	if lf.exclude, err = compilePatterns(m.Exclude, m.Regex, m.IgnoreCase); err != nil {
+		return nil, fmt.Errorf("exclude: %w", err)
+	}
+	return &lf, nil
+}
+
+func compilePatterns(patterns []string, regex bool, ignoreCase bool) (matchers []func([]byte) bool, err error) {
+	for _, p := range patterns {
+		if p == "" {
+			continue
+		}
+		if !regex && !ignoreCase {
+			sub := []byte(p)
+			matchers = append(matchers, func(line []byte) bool { return bytes.Contains(line, sub) })
+			continue
+		}
+		if !regex {
+			p = regexp.QuoteMeta(p)
+		}
+		if ignoreCase {
+			p = "(?i)" + p
+		}
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("compile %q: %w", p, err)
+		}
+		matchers = append(matchers, re.Match)
+	}
+	return matchers, nil
+}
+
+func (lf *LineFilter) Match(line []byte) bool {
+	if lf == nil {
+		return true
+	}
+	line = bytes.TrimRight(line, "\r\n")
+	if len(lf.include) > 0 && !matchAny(lf.include, line) {
+		return false
+	}
+	return !matchAny(lf.exclude, line)
+}
+
+func matchAny(matchers []func([]byte) bool, line []byte) bool {
+	for _, m := range matchers {
+		if m(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads the messages sent by the client until the connection fails,
+// queuing them for the streaming goroutine.
+//
+// The read deadline is extended by every pong and message, so that
+// a peer that stopped answering pings is eventually noticed.
+func (s *Stream) readControls() {
+	s.extendReadDeadline()
+	s.conn.SetPongHandler(func(string) error {
+		s.extendReadDeadline()
+		return nil
+	})
+	for {
+		t, b, err := s.conn.ReadMessage()
+		if err != nil {
+			s.sr.log.Printf("%s Read error: %+v", s.tag, err)
+			return
+		}
+		s.extendReadDeadline()
+		if t != websocket.TextMessage {
+			s.sr.log.Printf("%s Unexpected read (type %d): %q", s.tag, t, string(b))
+			continue
+		}
+		var m ControlMessage
+		if err := json.Unmarshal(b, &m); err != nil {
+			m.err = fmt.Errorf("malformed control message: %w", err)
+		}
+		s.sr.log.Printf("%s Control message: %s", s.tag, strings.TrimSpace(string(b)))
+		select {
+		case s.controls <- m:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// Allows a ping interval plus the time to write the ping before timing out.
+func (s *Stream) extendReadDeadline() {
+	cfg := s.w.cfg
+	if cfg.pingInterval <= 0 {
+		return
+	}
+	wait := time.Duration(cfg.pingInterval+max(cfg.writeTimeout, 0)) * time.Millisecond
+	s.conn.SetReadDeadline(time.Now().Add(wait))
+}
+
+// Applies a control message and answers it. Must only be
+// called from the streaming goroutine.
+//
+// Returns [errRestart] if the stream must start over,
+// in which case the answer is sent after restarting.
+func (s *Stream) handleControl(m ControlMessage) error {
+	if m.err != nil {
+		return s.sendFrame(errorFrame(m, m.err))
+	}
+	switch m.Type {
+	case CONTROL_FILTER:
+		lf, err := newLineFilter(m)
+		if err != nil {
+			return s.sendFrame(errorFrame(m, err))
+		}
+		s.filter = lf
+	case CONTROL_PAUSE:
+		s.paused = true
+	case CONTROL_RESUME:
+		s.paused = false
+	case CONTROL_SEEK:
+		req, err := m.startRequest()
+		if err != nil {
+			return s.sendFrame(errorFrame(m, err))
+		}
+		s.restart = req
+		s.restartCmd = m
+		return errRestart
+	case CONTROL_RESYNC:
+		s.restart = StartRequest{mode: START_OFFSET, offset: s.sent}
+		s.restartCmd = m
+		return errRestart
+	default:
+		return s.sendFrame(errorFrame(m, fmt.Errorf("unknown control message type %q", m.Type)))
+	}
+	return s.sendFrame(ackFrame(m, s.sent))
+}
+
+func (s *Stream) sendFrame(f ControlFrame) error {
+	b, err := encodeFrame(f)
+	if err != nil {
+		return err
+	}
+	return s.w.write(OutMessage{t: websocket.TextMessage, b: b})
+}
+
+func encodeFrame(f ControlFrame) ([]byte, error) {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return nil, fmt.Errorf("marshal frame: %w", err)
+	}
+	return append([]byte{CONTROL_FRAME_PREFIX}, b...), nil
+}
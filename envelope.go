@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// How lines are framed when sent to the client, chosen with
+// the "envelope" query parameter of the "/src/.../$" endpoint.
+type Envelope int
+
+const (
+	// Raw line bytes, as text messages. The default.
+	ENVELOPE_NONE Envelope = iota
+	// A [LineEnvelope] encoded as JSON, as text messages.
+	ENVELOPE_JSON
+	// A [LineEnvelope] encoded with [appendBinaryEnvelope], as binary messages.
+	ENVELOPE_BINARY
+)
+
+func parseEnvelope(v string) (Envelope, error) {
+	switch v {
+	case "", "none":
+		return ENVELOPE_NONE, nil
+	case "json":
+		return ENVELOPE_JSON, nil
+	case "binary":
+		return ENVELOPE_BINARY, nil
+	}
+	return ENVELOPE_NONE, fmt.Errorf("invalid envelope %q: must be \"none\", \"json\" or \"binary\"", v)
+}
+
+// A streamed line along with its metadata.
+type LineEnvelope struct {
+	// Offset of the line within the logical source.
+	Offset int64 `json:"offset"`
+	// 1-based line number within the logical source. Zero when unknown,
+	// which is the case for streams that didn't start at offset zero.
+	Line int64 `json:"line,omitempty"`
+	// When the server read the line, in Unix milliseconds.
+	Time int64 `json:"time"`
+	// The path of the source.
+	Source string `json:"source"`
+	// The line itself, including its line break if it has one.
+	Text string `json:"text"`
+	// Passed back as the "resume" query parameter when reconnecting,
+	// to continue right after this line. See [Cursor].
+	Cursor string `json:"cursor"`
+}
+
+// Version of the binary envelope layout, its first byte.
+const BINARY_ENVELOPE_VERSION byte = 1
+
+// Appends the binary encoding of e to b. All integers are big-endian:
+//
+//	u32 length of the rest of the envelope
+//	u8  [BINARY_ENVELOPE_VERSION]
+//	i64 offset
+//	i64 line
+//	i64 time, in Unix milliseconds
+//	u16 source length, followed by the source
+//	u32 text length, followed by the text
+//	u16 cursor length, followed by the cursor
+//
+// The leading length allows several envelopes to share a single message.
+func appendBinaryEnvelope(b []byte, e *LineEnvelope) []byte {
+	size := 1 + 8*3 + 2 + len(e.Source) + 4 + len(e.Text) + 2 + len(e.Cursor)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, BINARY_ENVELOPE_VERSION)
+	b = binary.BigEndian.AppendUint64(b, uint64(e.Offset))
+	b = binary.BigEndian.AppendUint64(b, uint64(e.Line))
+	b = binary.BigEndian.AppendUint64(b, uint64(e.Time))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(e.Source)))
+	b = append(b, e.Source...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(e.Text)))
+	b = append(b, e.Text...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(e.Cursor)))
+	return append(b, e.Cursor...)
+}
+
+// Encodes line according to [Stream.envelope], returning the message type and payload.
+func (s *Stream) encodeLine(line []byte, offset int64, cursor Cursor) (int, []byte, error) {
+	if s.envelope == ENVELOPE_NONE {
+		return websocket.TextMessage, line, nil
+	}
+	e := LineEnvelope{
+		Offset: offset,
+		Line:   s.lineNo,
+		Time:   time.Now().UnixMilli(),
+		Source: s.vsd.path,
+		Text:   string(line),
+		Cursor: cursor.String(),
+	}
+	if s.envelope == ENVELOPE_BINARY {
+		return websocket.BinaryMessage, appendBinaryEnvelope(nil, &e), nil
+	}
+	b, err := json.Marshal(&e)
+	if err != nil {
+		return 0, nil, fmt.Errorf("marshal envelope: %w", err)
+	}
+	return websocket.TextMessage, b, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+const (
+	FOLLOW_AUTO    string = "auto"
+	FOLLOW_POLLING string = "polling"
+)
+
+func validateFollowMode(mode string) error {
+	switch mode {
+	case FOLLOW_AUTO, FOLLOW_POLLING:
+		return nil
+	}
+	return fmt.Errorf("unknown follow mode %q: must be %q or %q", mode, FOLLOW_AUTO, FOLLOW_POLLING)
+}
+
+// Tells a stream when the file it follows may have changed.
+type Follower interface {
+	// Returns a channel that receives once the file may have changed.
+	// Must be called again after every receive.
+	Changed() <-chan struct{}
+	Close()
+}
+
+// Wakes up every [ServerConfig.pollingInterval], whether
+// the file changed or not.
+type PollingFollower struct {
+	interval time.Duration
+	t        *time.Timer
+	c        chan struct{}
+}
+
+func newPollingFollower(interval time.Duration) *PollingFollower {
+	p := &PollingFollower{
+		interval: interval,
+		c:        make(chan struct{}, 1),
+	}
+	p.t = time.AfterFunc(interval, func() {
+		select {
+		case p.c <- struct{}{}:
+		default:
+		}
+	})
+	return p
+}
+
+func (p *PollingFollower) Changed() <-chan struct{} {
+	p.t.Reset(p.interval)
+	return p.c
+}
+
+func (p *PollingFollower) Close() {
+	p.t.Stop()
+}
+
+// Wakes up on file system events reported by a [Watcher].
+type EventFollower struct {
+	sub *Subscription
+}
+
+func (e *EventFollower) Changed() <-chan struct{} {
+	return e.sub.C
+}
+
+func (e *EventFollower) Close() {
+	e.sub.Close()
+}
+
+// A registration for events on the entries of a single directory.
+type Subscription struct {
+	w   *Watcher
+	dir string
+	// Selects the directory entries this subscription cares about.
+	match func(name string) bool
+	// Receives a value when a matching entry changes.
+	// Events are coalesced while the channel is full.
+	C chan struct{}
+}
+
+func (s *Subscription) notify() {
+	select {
+	case s.C <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Subscription) Close() {
+	s.w.unsubscribe(s)
+}
+
+// Initializes [ServerResources.watcher] according to [ServerConfig.followMode].
+//
+// A watcher that can't be created is not an error, streams
+// simply fall back to polling.
+func initWatcher(sr *ServerResources) error {
+	switch sr.config().followMode {
+	case FOLLOW_POLLING:
+		sr.log.Printf("Following files by polling every %dms.", sr.config().pollingInterval)
+	case FOLLOW_AUTO:
+		w, err := newWatcher(getLogger("[Watcher]"))
+		if err != nil {
+			sr.log.Printf("File watcher unavailable, falling back to polling: %+v", err)
+			return nil
+		}
+		sr.watcher = w
+		sr.log.Print("Following files with file system events.")
+	default:
+		return fmt.Errorf("unknown follow mode %q", sr.config().followMode)
+	}
+	return nil
+}
+
+// Returns a [Follower] for the file at path, preferring
+// events from [ServerResources.watcher] if available.
+func newFollower(sr *ServerResources, path string) Follower {
+	if sr.watcher != nil {
+		name := filepath.Base(path)
+		sub, err := sr.watcher.Subscribe(filepath.Dir(path), func(n string) bool { return n == name })
+		if err == nil {
+			return &EventFollower{sub: sub}
+		}
+		sr.log.Printf("Watch %q failed, falling back to polling: %+v", path, err)
+	}
+	return newPollingFollower(time.Duration(sr.config().pollingInterval) * time.Millisecond)
+}
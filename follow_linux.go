@@ -0,0 +1,159 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Events on directory entries that may affect a stream.
+const INOTIFY_MASK uint32 = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+
+// Dispatches inotify events to [Subscription]s.
+//
+// A single inotify instance is shared by all streams, and directories
+// (not files) are watched so that renamed and re-created files are
+// still reported under their original name.
+type Watcher struct {
+	log *log.Logger
+	fd  int
+	// Wraps fd, so reads go through the runtime poller.
+	f    *os.File
+	mu   sync.Mutex
+	dirs map[string]*watchedDir
+	wds  map[int32]*watchedDir
+}
+
+type watchedDir struct {
+	path string
+	wd   int32
+	subs map[*Subscription]struct{}
+}
+
+func newWatcher(l *log.Logger) (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify init: %w", err)
+	}
+	w := &Watcher{
+		log:  l,
+		fd:   fd,
+		f:    os.NewFile(uintptr(fd), "inotify"),
+		dirs: make(map[string]*watchedDir),
+		wds:  make(map[int32]*watchedDir),
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+// Subscribes to events on the entries of dir selected by match.
+func (w *Watcher) Subscribe(dir string, match func(name string) bool) (*Subscription, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	wdir, ok := w.dirs[dir]
+	if !ok {
+		wd, err := syscall.InotifyAddWatch(w.fd, dir, INOTIFY_MASK)
+		if err != nil {
+			return nil, fmt.Errorf("inotify add watch %q: %w", dir, err)
+		}
+		wdir = &watchedDir{
+			path: dir,
+			wd:   int32(wd),
+			subs: make(map[*Subscription]struct{}),
+		}
+		w.dirs[dir] = wdir
+		w.wds[wdir.wd] = wdir
+	}
+	sub := &Subscription{
+		w:     w,
+		dir:   dir,
+		match: match,
+		C:     make(chan struct{}, 1),
+	}
+	wdir.subs[sub] = struct{}{}
+	return sub, nil
+}
+
+func (w *Watcher) unsubscribe(sub *Subscription) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	wdir, ok := w.dirs[sub.dir]
+	if !ok {
+		return
+	}
+	delete(wdir.subs, sub)
+	if len(wdir.subs) == 0 {
+		syscall.InotifyRmWatch(w.fd, uint32(wdir.wd))
+		delete(w.dirs, wdir.path)
+		delete(w.wds, wdir.wd)
+	}
+}
+
+func (w *Watcher) readEvents() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrClosed) {
+				w.log.Printf("Read error, watcher stopped: %+v", err)
+			}
+			return
+		}
+		w.dispatch(buf[:n])
+	}
+}
+
+func (w *Watcher) dispatch(buf []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for len(buf) >= syscall.SizeofInotifyEvent {
+		e := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[0]))
+		end := syscall.SizeofInotifyEvent + int(e.Len)
+		if end > len(buf) {
+			return
+		}
+		name := string(bytes.TrimRight(buf[syscall.SizeofInotifyEvent:end], "\x00"))
+		buf = buf[end:]
+
+		if e.Mask&syscall.IN_Q_OVERFLOW != 0 {
+			w.log.Print("Event queue overflow, waking up all subscribers.")
+			for _, wdir := range w.dirs {
+				for sub := range wdir.subs {
+					sub.notify()
+				}
+			}
+			continue
+		}
+		wdir, ok := w.wds[e.Wd]
+		if !ok {
+			continue
+		}
+		if e.Mask&syscall.IN_IGNORED != 0 {
+			// The directory is gone, let subscribers find out by themselves.
+			for sub := range wdir.subs {
+				sub.notify()
+			}
+			delete(w.dirs, wdir.path)
+			delete(w.wds, wdir.wd)
+			continue
+		}
+		for sub := range wdir.subs {
+			if sub.match(name) {
+				sub.notify()
+			}
+		}
+	}
+}
+
+func (w *Watcher) Close() error {
+	return w.f.Close()
+}
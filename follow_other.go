@@ -0,0 +1,26 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+// File system events are only implemented on Linux,
+// other platforms always follow files by polling.
+type Watcher struct{}
+
+func newWatcher(l *log.Logger) (*Watcher, error) {
+	return nil, errors.New("file system events not supported on this platform")
+}
+
+func (w *Watcher) Subscribe(dir string, match func(name string) bool) (*Subscription, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (w *Watcher) unsubscribe(sub *Subscription) {}
+
+func (w *Watcher) Close() error {
+	return nil
+}
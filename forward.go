@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+func validateForwardListen(v string) error {
+	_, err := parseListenAddresses(v, false, "tcp", "unix")
+	return err
+}
+
+// Max size of the entries of a PackedForward message, once decompressed.
+const MAX_FORWARD_ENTRIES_SIZE int = 32 << 20
+
+var errForwardTooLarge = errors.New("decompressed entries too large")
+
+// Max size of a Forward message as sent on the wire, options included.
+const MAX_FORWARD_MESSAGE_SIZE int = MAX_FORWARD_ENTRIES_SIZE + 1<<20
+
+// Record keys holding the message of Fluent events, first match wins.
+// "log" is used by Docker's fluentd log driver.
+var forwardMessageKeys = []string{"log", "message", "msg"}
+
+// Fields added by Docker's fluentd log driver to every event, kept out of
+// captured lines since they are the same for a whole capture file.
+var forwardDockerFields = map[string]bool{
+	"container_id":   true,
+	"container_name": true,
+}
+
+// A Fluent event, with the tag it was received with.
+type ForwardEvent struct {
+	tag    string
+	time   time.Time
+	record []KeyValue
+}
+
+// Decodes a Fluent Forward message in any of its modes, see
+// https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1:
+//
+//	Message:        [tag, time, record, option?]
+//	Forward:        [tag, [[time, record], ...], option?]
+//	PackedForward:  [tag, <msgpack stream of [time, record]>, option?]
+//
+// PackedForward streams may be gzipped, as told by the "compressed" option.
+// Returns the events along with the options, if any.
+func decodeForwardMessage(v any) ([]ForwardEvent, []KeyValue, error) {
+	msg, ok := v.([]any)
+	if !ok || len(msg) < 2 {
+		return nil, nil, fmt.Errorf("malformed message: expected an array of at least 2 elements")
+	}
+	tag, ok := forwardString(msg[0])
+	if !ok {
+		return nil, nil, fmt.Errorf("malformed message: the tag must be a string")
+	}
+	option := func(i int) []KeyValue {
+		if i >= len(msg) {
+			return nil
+		}
+		opts, _ := msg[i].([]KeyValue)
+		return opts
+	}
+	var events []ForwardEvent
+	switch entries := msg[1].(type) {
+	case []any:
+		for _, entry := range entries {
+			e, err := decodeForwardEntry(tag, entry)
+			if err != nil {
+				return nil, nil, err
+			}
+			events = append(events, e)
+		}
+		return events, option(2), nil
+	case string, []byte:
+		opts := option(2)
+		packed, _ := forwardString(entries)
+		var r io.Reader = strings.NewReader(packed)
+		if c, _ := lookupField(opts, "compressed").(string); c == "gzip" {
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, nil, fmt.Errorf("malformed compressed entries: %w", err)
+			}
+			b, err := io.ReadAll(io.LimitReader(gz, int64(MAX_FORWARD_ENTRIES_SIZE)+1))
+			if err == nil && len(b) > MAX_FORWARD_ENTRIES_SIZE {
+				err = errForwardTooLarge
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("malformed compressed entries: %w", err)
+			}
+			r = bytes.NewReader(b)
+		}
+		d := newMsgpackReader(r)
+		for {
+			entry, err := d.decode()
+			if err == io.EOF {
+				return events, opts, nil
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("malformed packed entries: %w", err)
+			}
+			e, err := decodeForwardEntry(tag, entry)
+			if err != nil {
+				return nil, nil, err
+			}
+			events = append(events, e)
+		}
+	}
+	if len(msg) < 3 {
+		return nil, nil, fmt.Errorf("malformed message: missing record")
+	}
+	e, err := decodeForwardEntry(tag, []any{msg[1], msg[2]})
+	if err != nil {
+		return nil, nil, err
+	}
+	return []ForwardEvent{e}, option(3), nil
+}
+
+// Decodes a [time, record] entry.
+func decodeForwardEntry(tag string, v any) (ForwardEvent, error) {
+	entry, ok := v.([]any)
+	if !ok || len(entry) < 2 {
+		return ForwardEvent{}, fmt.Errorf("malformed entry: expected [time, record]")
+	}
+	record, ok := entry[1].([]KeyValue)
+	if !ok {
+		return ForwardEvent{}, fmt.Errorf("malformed entry: the record must be a map")
+	}
+	return ForwardEvent{tag: tag, time: forwardTime(entry[0]), record: record}, nil
+}
+
+// Decodes an event time, either seconds since the epoch or an EventTime
+// extension, holding seconds and nanoseconds. Invalid times are replaced with now.
+func forwardTime(v any) time.Time {
+	switch v := v.(type) {
+	case int64:
+		return time.Unix(v, 0)
+	case uint64:
+		return time.Unix(int64(min(v, math.MaxInt64)), 0)
+	case float64:
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(frac*1e9))
+	case MsgpackExt:
+		if v.typ == 0 && len(v.data) == 8 {
+			return time.Unix(int64(binary.BigEndian.Uint32(v.data)), int64(binary.BigEndian.Uint32(v.data[4:])))
+		}
+	}
+	return time.Now()
+}
+
+// Returns strings, and binaries holding valid UTF-8, which some
+// clients send strings as, following an older msgpack spec.
+func forwardString(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), utf8.Valid(v)
+	}
+	return "", false
+}
+
+// Returns the value of the first field named key, or nil.
+func lookupField(kvs []KeyValue, key string) any {
+	for _, kv := range kvs {
+		if kv.key == key {
+			return kv.value
+		}
+	}
+	return nil
+}
+
+// Returns the capture id of e: the container that sent it, if any, or its tag.
+func (e *ForwardEvent) captureId() string {
+	name, _ := forwardString(lookupField(e.record, "container_name"))
+	return firstNonEmpty(strings.TrimPrefix(name, "/"), e.tag)
+}
+
+// Formats e as a single line:
+//
+//	<time> <key>=<value>...: <message>
+//
+// The message is the first of [forwardMessageKeys] found in the record,
+// other fields are written before it, as are all fields of records without one.
+func (e *ForwardEvent) appendLine(b []byte) []byte {
+	b = e.time.UTC().AppendFormat(b, INGEST_TIME_FORMAT)
+	msgKey := ""
+	for _, key := range forwardMessageKeys {
+		if _, ok := forwardString(lookupField(e.record, key)); ok {
+			msgKey = key
+			break
+		}
+	}
+	for _, kv := range e.record {
+		if kv.key == msgKey || forwardDockerFields[kv.key] {
+			continue
+		}
+		if s, ok := forwardString(kv.value); ok {
+			kv.value = s
+		}
+		b = appendField(b, kv)
+	}
+	b = append(b, ": "...)
+	if msgKey != "" {
+		msg, _ := forwardString(lookupField(e.record, msgKey))
+		b = appendEscapedLine(b, msg)
+	}
+	return append(b, '\n')
+}
+
+// Returns the response acknowledging a message sent with opts,
+// or nil if it doesn't ask for one.
+func forwardAck(opts []KeyValue) []byte {
+	chunk, ok := lookupField(opts, "chunk").(string)
+	if !ok {
+		return nil
+	}
+	// {"ack": chunk}
+	ack := appendMsgpackString([]byte{0x81}, "ack")
+	return appendMsgpackString(ack, chunk)
+}
+
+// Receives Fluent Forward events on [IngestConfig.forward].
+func (cl *CaptureListener) startForward() error {
+	addrs, err := parseListenAddresses(cl.g.forward, false, "tcp", "unix")
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		l, err := cl.listen(a)
+		if err != nil {
+			return err
+		}
+		go cl.accept(l, a, cl.serveForward)
+		log.Printf("Receiving Fluent Forward events on %s.", a)
+	}
+	return nil
+}
+
+// Reads Fluent Forward messages from conn, acknowledging those that ask for it
+// once their events are written. Authentication handshakes are not supported.
+func (cl *CaptureListener) serveForward(conn net.Conn, a ListenAddress) {
+	peer := peerName(conn, a)
+	d := newMsgpackReader(bufio.NewReaderSize(conn, LINE_BUFFER_SIZE))
+	d.limit = MAX_FORWARD_MESSAGE_SIZE
+	var line []byte
+	for {
+		v, err := d.decode()
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("[%s] Forward error: %+v", peer, err)
+			return
+		}
+		events, opts, err := decodeForwardMessage(v)
+		if err != nil {
+			log.Printf("[%s] Forward error: %+v", peer, err)
+			return
+		}
+		for i := range events {
+			line = events[i].appendLine(line[:0])
+			if err := cl.write(sanitizeCaptureId(events[i].captureId()), line); err != nil {
+				// Unacknowledged, the client may send the message again.
+				log.Printf("[%s] Capture error: %+v", peer, err)
+				return
+			}
+		}
+		if ack := forwardAck(opts); ack != nil {
+			if _, err := conn.Write(ack); err != nil {
+				log.Printf("[%s] Forward error: %+v", peer, err)
+				return
+			}
+		}
+	}
+}
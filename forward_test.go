@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Appends v as msgpack, for the types decoded by [MsgpackReader] that tests use.
+func appendMsgpack(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case int64:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(v))
+	case string:
+		return appendMsgpackString(b, v)
+	case []byte:
+		return append(binary.BigEndian.AppendUint32(append(b, 0xc6), uint32(len(v))), v...)
+	case []any:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(len(v)))
+		for _, item := range v {
+			b = appendMsgpack(b, item)
+		}
+		return b
+	case []KeyValue:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(len(v)))
+		for _, kv := range v {
+			b = appendMsgpack(appendMsgpackString(b, kv.key), kv.value)
+		}
+		return b
+	case MsgpackExt:
+		b = binary.BigEndian.AppendUint32(append(b, 0xc9), uint32(len(v.data)))
+		return append(append(b, byte(v.typ)), v.data...)
+	}
+	panic("unsupported value")
+}
+
+// Returns the msgpack stream of entries, as sent in PackedForward mode.
+func packForwardEntries(entries ...[]any) []byte {
+	var b []byte
+	for _, e := range entries {
+		b = appendMsgpack(b, e)
+	}
+	return b
+}
+
+func TestDecodeForwardMessage(t *testing.T) {
+	t1, t2 := time.Unix(1714564800, 0), time.Unix(1714564801, 500)
+	eventTime := MsgpackExt{0, []byte{0x66, 0x32, 0x2e, 0xc1, 0, 0, 0x01, 0xf4}}
+	rec1 := []KeyValue{{"log", "first"}, {"container_name", "/web"}}
+	rec2 := []KeyValue{{"message", "second"}, {"n", int64(2)}}
+	chunk := []KeyValue{{"chunk", "c2VjcmV0"}}
+	packed := packForwardEntries([]any{int64(t1.Unix()), rec1}, []any{eventTime, rec2})
+	events := []ForwardEvent{{"app", t1, rec1}, {"app", t2, rec2}}
+
+	tests := []struct {
+		name   string
+		msg    []any
+		events []ForwardEvent
+		opts   []KeyValue
+	}{
+		{"message", []any{"app", int64(t1.Unix()), rec1}, events[:1], nil},
+		{"message with options", []any{"app", eventTime, rec2, chunk}, events[1:], chunk},
+		{"forward", []any{"app", []any{[]any{int64(t1.Unix()), rec1}, []any{eventTime, rec2}}}, events, nil},
+		{"forward with options", []any{"app", []any{[]any{int64(t1.Unix()), rec1}}, chunk}, events[:1], chunk},
+		{"packed forward", []any{"app", string(packed), chunk}, events, chunk},
+		{"packed forward in a binary", []any{"app", packed}, events, nil},
+		{"compressed packed forward", []any{"app", gzipped(packed), []KeyValue{{"compressed", "gzip"}, chunk[0]}}, events,
+			[]KeyValue{{"compressed", "gzip"}, chunk[0]}},
+		{"empty forward", []any{"app", []any{}}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Decoded from the wire, as the server does.
+			v, err := newMsgpackReader(bytes.NewReader(appendMsgpack(nil, tt.msg))).decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			events, opts, err := decodeForwardMessage(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(events, tt.events) {
+				t.Errorf("events:\n got %+v\nwant %+v", events, tt.events)
+			}
+			if !reflect.DeepEqual(opts, tt.opts) {
+				t.Errorf("options %+v, want %+v", opts, tt.opts)
+			}
+		})
+	}
+}
+
+func TestDecodeForwardMessageMalformed(t *testing.T) {
+	rec := []KeyValue{{"log", "x"}}
+	packed := packForwardEntries([]any{int64(1), rec})
+	tests := []struct {
+		name string
+		msg  any
+	}{
+		{"not an array", "app"},
+		{"too short", []any{"app"}},
+		{"tag not a string", []any{int64(1), int64(1), rec}},
+		{"missing record", []any{"app", int64(1)}},
+		{"record not a map", []any{"app", int64(1), "x"}},
+		{"forward entry not an array", []any{"app", []any{"x"}}},
+		{"forward entry too short", []any{"app", []any{[]any{int64(1)}}}},
+		{"packed entries truncated", []any{"app", string(packed[:len(packed)-1])}},
+		{"packed entry not an entry", []any{"app", string(appendMsgpack(nil, "x"))}},
+		{"compressed entries not gzipped", []any{"app", string(packed), []KeyValue{{"compressed", "gzip"}}}},
+		{"compressed entries truncated", []any{"app", string(gzipped(packed)[:15]), []KeyValue{{"compressed", "gzip"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if events, _, err := decodeForwardMessage(tt.msg); err == nil {
+				t.Errorf("got %+v, want an error", events)
+			}
+		})
+	}
+}
+
+func TestDecodeForwardMessageTooLarge(t *testing.T) {
+	// A string of zeroes, which compresses down to a tiny fraction of its size.
+	entry := appendMsgpack(nil, []any{int64(1), []KeyValue{{"log", strings.Repeat("0", MAX_FORWARD_ENTRIES_SIZE)}}})
+	compressed := gzipped(entry)
+	msg := []any{"app", string(compressed), []KeyValue{{"compressed", "gzip"}}}
+	if _, _, err := decodeForwardMessage(msg); !errors.Is(err, errForwardTooLarge) {
+		t.Errorf("error %v, want %v", err, errForwardTooLarge)
+	}
+}
+
+func TestForwardAck(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []KeyValue
+		want []byte
+	}{
+		{"chunk", []KeyValue{{"size", int64(1)}, {"chunk", "abc"}}, []byte("\x81\xa3ack\xa3abc")},
+		{"no chunk", []KeyValue{{"size", int64(1)}}, nil},
+		{"no options", nil, nil},
+		{"chunk not a string", []KeyValue{{"chunk", int64(1)}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := forwardAck(tt.opts)
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardEventAppendLine(t *testing.T) {
+	e := ForwardEvent{
+		tag:    "docker.web",
+		time:   time.Unix(1714564800, 123e6),
+		record: []KeyValue{{"container_id", "abc"}, {"container_name", "/web"}, {"source", []byte("stdout")}, {"log", "hello\nworld"}},
+	}
+	if got, want := e.captureId(), "web"; got != want {
+		t.Errorf("capture id %q, want %q", got, want)
+	}
+	if got, want := string(e.appendLine(nil)), `2024-05-01T12:00:00.123Z source=stdout: hello\nworld`+"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func validateGelfListen(v string) error {
+	_, err := parseListenAddresses(v, false, "udp", "tcp")
+	return err
+}
+
+// Max size of a GELF message, once reassembled and decompressed.
+const MAX_GELF_MESSAGE_SIZE int = 1 << 20
+
+// Chunked GELF datagrams, see https://go2docs.graylog.org/current/getting_in_log_data/gelf.html.
+const (
+	// Starts every chunk, followed by an 8 bytes message id, the sequence number and count.
+	GELF_CHUNK_MAGIC       string = "\x1e\x0f"
+	GELF_CHUNK_HEADER_SIZE int    = 12
+	MAX_GELF_CHUNKS        int    = 128
+	// Messages still missing chunks after this long are dropped.
+	GELF_CHUNK_TIMEOUT time.Duration = 5 * time.Second
+	// Messages being reassembled at once by a single listener.
+	MAX_GELF_PENDING int = 1024
+)
+
+// Fields added by Docker's gelf log driver to every message, kept out of
+// captured lines since they are the same for a whole capture file.
+var gelfDockerFields = map[string]bool{
+	"_container_id":   true,
+	"_container_name": true,
+	"_image_id":       true,
+	"_image_name":     true,
+	"_command":        true,
+	"_created":        true,
+	"_tag":            true,
+}
+
+var errGelfTooLarge = errors.New("message too large")
+
+// Reassembles chunked GELF messages. Owned by the goroutine reading datagrams.
+type GelfAssembler struct {
+	pending map[[8]byte]*GelfPartial
+}
+
+type GelfPartial struct {
+	chunks   [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+func newGelfAssembler() *GelfAssembler {
+	return &GelfAssembler{pending: make(map[[8]byte]*GelfPartial)}
+}
+
+// Adds a chunk, returning the whole message once every chunk was received,
+// or nil. Chunks are copied, and received once; duplicates are ignored.
+func (a *GelfAssembler) add(p []byte, now time.Time) ([]byte, error) {
+	if len(p) < GELF_CHUNK_HEADER_SIZE {
+		return nil, errProtoTruncated
+	}
+	id := [8]byte(p[2:10])
+	seq, count := int(p[10]), int(p[11])
+	if count == 0 || count > MAX_GELF_CHUNKS || seq >= count {
+		return nil, fmt.Errorf("invalid chunk %d of %d", seq, count)
+	}
+	m, ok := a.pending[id]
+	if !ok {
+		a.expire(now)
+		if len(a.pending) >= MAX_GELF_PENDING {
+			return nil, fmt.Errorf("too many chunked messages pending")
+		}
+		m = &GelfPartial{chunks: make([][]byte, count), started: now}
+		a.pending[id] = m
+	}
+	if len(m.chunks) != count {
+		return nil, fmt.Errorf("chunk count changed from %d to %d", len(m.chunks), count)
+	}
+	if m.chunks[seq] != nil {
+		return nil, nil
+	}
+	m.chunks[seq] = bytes.Clone(p[GELF_CHUNK_HEADER_SIZE:])
+	m.received++
+	m.size += len(p) - GELF_CHUNK_HEADER_SIZE
+	if m.size > MAX_GELF_MESSAGE_SIZE {
+		delete(a.pending, id)
+		return nil, errGelfTooLarge
+	}
+	if m.received < count {
+		return nil, nil
+	}
+	delete(a.pending, id)
+	return bytes.Join(m.chunks, nil), nil
+}
+
+// Drops the messages still missing chunks after [GELF_CHUNK_TIMEOUT].
+func (a *GelfAssembler) expire(now time.Time) {
+	for id, m := range a.pending {
+		if now.Sub(m.started) > GELF_CHUNK_TIMEOUT {
+			log.Printf("Dropped a GELF message missing %d of %d chunks.", len(m.chunks)-m.received, len(m.chunks))
+			delete(a.pending, id)
+		}
+	}
+}
+
+// Decompresses a GELF payload compressed with gzip or zlib, as told by its magic bytes.
+// Uncompressed payloads are returned as is.
+func decompressGelf(p []byte) ([]byte, error) {
+	var r io.Reader
+	var err error
+	switch {
+	case len(p) >= 2 && p[0] == 0x1f && p[1] == 0x8b:
+		r, err = gzip.NewReader(bytes.NewReader(p))
+	case len(p) >= 2 && p[0] == 0x78 && (uint16(p[0])<<8|uint16(p[1]))%31 == 0:
+		r, err = zlib.NewReader(bytes.NewReader(p))
+	default:
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(io.LimitReader(r, int64(MAX_GELF_MESSAGE_SIZE)+1))
+	if err == nil && len(b) > MAX_GELF_MESSAGE_SIZE {
+		err = errGelfTooLarge
+	}
+	return b, err
+}
+
+// A GELF message, with the fields Logyard keeps.
+type GelfMessage struct {
+	time  time.Time
+	host  string
+	level int
+	msg   string
+	// Additional fields, without their leading underscore.
+	fields []KeyValue
+	// Capture id, see [GelfMessage.captureId].
+	id string
+}
+
+// Parses a GELF message. received is used when it has no timestamp,
+// and from when it has no host.
+func parseGelf(b []byte, received time.Time, from string) (GelfMessage, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var fields map[string]any
+	if err := d.Decode(&fields); err != nil {
+		return GelfMessage{}, fmt.Errorf("malformed message: %w", err)
+	}
+	m := GelfMessage{time: received, host: from, level: -1}
+	str := func(key string) string {
+		s, _ := fields[key].(string)
+		return s
+	}
+	if host := str("host"); host != "" {
+		m.host = host
+	}
+	m.msg = str("full_message")
+	if m.msg == "" {
+		m.msg = str("short_message")
+	}
+	if n, ok := fields["timestamp"].(json.Number); ok {
+		if t, err := parseUnixSeconds(string(n)); err == nil {
+			m.time = t
+		}
+	}
+	if n, ok := fields["level"].(json.Number); ok {
+		if level, err := n.Int64(); err == nil && level >= 0 && level < int64(len(syslogSeverities)) {
+			m.level = int(level)
+		}
+	}
+	m.id = firstNonEmpty(strings.TrimPrefix(str("_container_name"), "/"), str("_tag"), m.host)
+	for _, kv := range sortedFields(fields) {
+		switch kv.key {
+		case "version", "host", "short_message", "full_message", "timestamp", "level":
+			continue
+		}
+		if gelfDockerFields[kv.key] {
+			continue
+		}
+		kv.key = strings.TrimPrefix(kv.key, "_")
+		m.fields = append(m.fields, kv)
+	}
+	return m, nil
+}
+
+// Returns the first value that isn't empty.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Parses seconds since the epoch, with an optional fraction.
+func parseUnixSeconds(v string) (time.Time, error) {
+	sec, frac, _ := strings.Cut(v, ".")
+	s, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var ns int64
+	if frac != "" {
+		frac = (frac + "000000000")[:9]
+		if ns, err = strconv.ParseInt(frac, 10, 64); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(s, ns), nil
+}
+
+// Formats m as a single line:
+//
+//	<time> <severity> <host> <key>=<value>...: <message>
+//
+// The severity is the syslog name of the level, or "-".
+func (m *GelfMessage) appendLine(b []byte) []byte {
+	b = m.time.UTC().AppendFormat(b, INGEST_TIME_FORMAT)
+	b = append(b, ' ')
+	if m.level >= 0 {
+		b = append(b, syslogSeverities[m.level]...)
+	} else {
+		b = append(b, '-')
+	}
+	b = append(b, ' ')
+	b = appendFieldValue(b, m.host)
+	for _, kv := range m.fields {
+		b = appendField(b, kv)
+	}
+	b = append(b, ": "...)
+	b = appendEscapedLine(b, m.msg)
+	return append(b, '\n')
+}
+
+// Receives GELF messages on [IngestConfig.gelf].
+func (cl *CaptureListener) startGelf() error {
+	addrs, err := parseListenAddresses(cl.g.gelf, false, "udp", "tcp")
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if a.network == "udp" {
+			pc, err := cl.listenPacket(a)
+			if err != nil {
+				return err
+			}
+			chunks := newGelfAssembler()
+			cl.readPackets(pc, a, func(p []byte, from net.Addr) {
+				var err error
+				if bytes.HasPrefix(p, []byte(GELF_CHUNK_MAGIC)) {
+					if p, err = chunks.add(p, time.Now()); p == nil {
+						if err != nil {
+							log.Printf("[%s] GELF error: %+v", from, err)
+						}
+						return
+					}
+				}
+				if p, err = decompressGelf(p); err != nil {
+					log.Printf("[%s] GELF error: %+v", from, err)
+					return
+				}
+				cl.writeGelf(p, hostOf(from))
+			})
+		} else {
+			l, err := cl.listen(a)
+			if err != nil {
+				return err
+			}
+			go cl.accept(l, a, cl.serveGelf)
+		}
+		log.Printf("Receiving GELF messages on %s.", a)
+	}
+	return nil
+}
+
+func (cl *CaptureListener) writeGelf(p []byte, from string) {
+	m, err := parseGelf(p, time.Now(), from)
+	if err != nil {
+		log.Printf("[%s] GELF error: %+v", from, err)
+		return
+	}
+	if err := cl.write(sanitizeCaptureId(m.id), m.appendLine(nil)); err != nil {
+		log.Printf("[%s] Capture error: %+v", from, err)
+	}
+}
+
+// Reads NUL-delimited GELF messages from a TCP connection.
+func (cl *CaptureListener) serveGelf(conn net.Conn, a ListenAddress) {
+	peer := peerName(conn, a)
+	from := hostOf(conn.RemoteAddr())
+	r := bufio.NewReaderSize(conn, LINE_BUFFER_SIZE)
+	var msg []byte
+	for {
+		frame, err := r.ReadSlice(0)
+		if msg = append(msg, frame...); len(msg) > MAX_GELF_MESSAGE_SIZE {
+			log.Printf("[%s] GELF error: %+v", peer, errGelfTooLarge)
+			return
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if msg = bytes.TrimSpace(bytes.TrimSuffix(msg, []byte{0})); len(msg) > 0 {
+			cl.writeGelf(msg, from)
+		}
+		msg = msg[:0]
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("[%s] GELF error: %+v", peer, err)
+			return
+		}
+	}
+}
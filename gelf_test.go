@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a chunk of the message with the given id.
+func gelfChunk(id byte, seq int, count int, data string) []byte {
+	b := []byte(GELF_CHUNK_MAGIC)
+	b = append(b, id, 0, 0, 0, 0, 0, 0, id)
+	b = append(b, byte(seq), byte(count))
+	return append(b, data...)
+}
+
+func TestGelfAssemblerAdd(t *testing.T) {
+	type step struct {
+		chunk []byte
+		// Since the first chunk.
+		at time.Duration
+		// The message completed by the chunk, if any.
+		want string
+		err  bool
+	}
+	large := strings.Repeat("x", MAX_GELF_MESSAGE_SIZE/2+1)
+	tests := []struct {
+		name  string
+		steps []step
+		// Messages left pending.
+		pending int
+	}{
+		{"single chunk", []step{
+			{chunk: gelfChunk(1, 0, 1, "abc"), want: "abc"},
+		}, 0},
+		{"in order", []step{
+			{chunk: gelfChunk(1, 0, 3, "a")},
+			{chunk: gelfChunk(1, 1, 3, "b")},
+			{chunk: gelfChunk(1, 2, 3, "c"), want: "abc"},
+		}, 0},
+		{"out of order", []step{
+			{chunk: gelfChunk(1, 2, 3, "c")},
+			{chunk: gelfChunk(1, 0, 3, "a")},
+			{chunk: gelfChunk(1, 1, 3, "b"), want: "abc"},
+		}, 0},
+		{"duplicate", []step{
+			{chunk: gelfChunk(1, 0, 2, "a")},
+			{chunk: gelfChunk(1, 0, 2, "z")},
+			{chunk: gelfChunk(1, 1, 2, "b"), want: "ab"},
+		}, 0},
+		{"duplicate after completion starts over", []step{
+			{chunk: gelfChunk(1, 0, 2, "a")},
+			{chunk: gelfChunk(1, 1, 2, "b"), want: "ab"},
+			{chunk: gelfChunk(1, 1, 2, "b")},
+		}, 1},
+		{"interleaved", []step{
+			{chunk: gelfChunk(1, 0, 2, "a")},
+			{chunk: gelfChunk(2, 1, 2, "d")},
+			{chunk: gelfChunk(2, 0, 2, "c"), want: "cd"},
+			{chunk: gelfChunk(1, 1, 2, "b"), want: "ab"},
+		}, 0},
+		{"count mismatch", []step{
+			{chunk: gelfChunk(1, 0, 2, "a")},
+			{chunk: gelfChunk(1, 1, 3, "b"), err: true},
+			{chunk: gelfChunk(1, 1, 2, "b"), want: "ab"},
+		}, 0},
+		{"sequence out of range", []step{
+			{chunk: gelfChunk(1, 2, 2, "a"), err: true},
+		}, 0},
+		{"no chunks", []step{
+			{chunk: gelfChunk(1, 0, 0, "a"), err: true},
+		}, 0},
+		{"too many chunks", []step{
+			{chunk: gelfChunk(1, 0, MAX_GELF_CHUNKS+1, "a"), err: true},
+		}, 0},
+		{"truncated header", []step{
+			{chunk: gelfChunk(1, 0, 2, "")[:GELF_CHUNK_HEADER_SIZE-1], err: true},
+		}, 0},
+		{"too large", []step{
+			{chunk: gelfChunk(1, 0, 3, large)},
+			{chunk: gelfChunk(1, 1, 3, large), err: true},
+			{chunk: gelfChunk(1, 2, 3, "c")},
+		}, 1},
+		{"completed before expiring", []step{
+			{chunk: gelfChunk(1, 0, 2, "a")},
+			{chunk: gelfChunk(2, 0, 2, "c"), at: GELF_CHUNK_TIMEOUT},
+			{chunk: gelfChunk(1, 1, 2, "b"), at: GELF_CHUNK_TIMEOUT, want: "ab"},
+		}, 1},
+		{"expired", []step{
+			{chunk: gelfChunk(1, 0, 2, "a")},
+			// Expiry is checked as new messages arrive.
+			{chunk: gelfChunk(2, 0, 2, "c"), at: GELF_CHUNK_TIMEOUT + time.Second},
+			// Starts over, missing the first chunk.
+			{chunk: gelfChunk(1, 1, 2, "b"), at: GELF_CHUNK_TIMEOUT + time.Second},
+		}, 2},
+	}
+	start := time.Unix(1714564800, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newGelfAssembler()
+			for i, s := range tt.steps {
+				got, err := a.add(s.chunk, start.Add(s.at))
+				if (err != nil) != s.err {
+					t.Fatalf("step %d: error %v, want error: %t", i, err, s.err)
+				}
+				if string(got) != s.want {
+					t.Fatalf("step %d: got %q, want %q", i, got, s.want)
+				}
+			}
+			if len(a.pending) != tt.pending {
+				t.Errorf("%d messages pending, want %d", len(a.pending), tt.pending)
+			}
+		})
+	}
+}
+
+func TestGelfAssemblerTooManyPending(t *testing.T) {
+	a := newGelfAssembler()
+	now := time.Unix(1714564800, 0)
+	for i := range MAX_GELF_PENDING {
+		chunk := gelfChunk(0, 0, 2, "a")
+		chunk[2], chunk[3] = byte(i), byte(i>>8)
+		if _, err := a.add(chunk, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.add(gelfChunk(1, 0, 2, "a"), now); err == nil {
+		t.Error("no error with too many messages pending")
+	}
+	// Room is made once the others expire.
+	if _, err := a.add(gelfChunk(1, 0, 2, "a"), now.Add(GELF_CHUNK_TIMEOUT+time.Second)); err != nil {
+		t.Error(err)
+	}
+	if len(a.pending) != 1 {
+		t.Errorf("%d messages pending, want 1", len(a.pending))
+	}
+}
+
+func TestDecompressGelf(t *testing.T) {
+	msg := []byte(`{"version":"1.1","host":"h","short_message":"hi"}`)
+	for _, p := range [][]byte{msg, gzipped(msg)} {
+		got, err := decompressGelf(p)
+		if err != nil || string(got) != string(msg) {
+			t.Errorf("got %q, %v", got, err)
+		}
+	}
+	large := gzipped([]byte(strings.Repeat(" ", MAX_GELF_MESSAGE_SIZE+1)))
+	if _, err := decompressGelf(large); !errors.Is(err, errGelfTooLarge) {
+		t.Errorf("error %v, want %v", err, errGelfTooLarge)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Layout of the timestamp starting every line received over the network,
+// in UTC, so that streams can seek by time.
+const INGEST_TIME_FORMAT string = "2006-01-02T15:04:05.000Z07:00"
+
+// Receives logs over the network in the formats set by [IngestConfig],
+// writing them into capture files until a shutdown is requested.
+func startIngest(g *Globals) error {
+	inputs := []struct {
+		name  string
+		addrs string
+		start func(cl *CaptureListener) error
+	}{
+		{"syslog", g.syslog, (*CaptureListener).startSyslog},
+		{"GELF", g.gelf, (*CaptureListener).startGelf},
+		{"forward", g.forward, (*CaptureListener).startForward},
+	}
+	cl := newCaptureListener(g)
+	started := 0
+	for _, in := range inputs {
+		if in.addrs == "" {
+			continue
+		}
+		if started == 0 {
+			log.Printf("Starting ingest mode. Capture path: %q", g.capturePath)
+		}
+		if err := in.start(cl); err != nil {
+			cl.closeListeners()
+			return fmt.Errorf("start %s: %w", in.name, err)
+		}
+		started++
+	}
+	if started == 0 {
+		return errors.New("no inputs to receive logs from, see \"logyard " + COMMAND_HELP + " " + COMMAND_INGEST + "\"")
+	}
+	return cl.run()
+}
+
+// A field of a structured log record, as in OTLP attributes or GELF additional fields.
+// Values are nil, string, bool, int64, uint64, float64, []byte, []any, []KeyValue,
+// or what [json.Decoder.UseNumber] decodes into.
+type KeyValue struct {
+	key   string
+	value any
+}
+
+// Sorts the fields of a JSON object by key, since their order is lost when decoding.
+func sortedFields(m map[string]any) []KeyValue {
+	kvs := make([]KeyValue, 0, len(m))
+	for k, v := range m {
+		kvs = append(kvs, KeyValue{k, v})
+	}
+	slices.SortFunc(kvs, func(a, b KeyValue) int { return strings.Compare(a.key, b.key) })
+	return kvs
+}
+
+// Appends " key=value", with string values written as is unless ambiguous,
+// and others written as JSON.
+func appendField(b []byte, kv KeyValue) []byte {
+	b = append(b, ' ')
+	b = appendFieldValue(b, kv.key)
+	b = append(b, '=')
+	if s, ok := kv.value.(string); ok {
+		return appendFieldValue(b, s)
+	}
+	return appendStructuredValue(b, kv.value)
+}
+
+// Appends s, quoted if empty or if it contains anything that would
+// make the line ambiguous.
+func appendFieldValue(b []byte, s string) []byte {
+	if s != "" && !strings.ContainsAny(s, " =:\"\\") && strconv.CanBackquote(s) {
+		return append(b, s...)
+	}
+	return strconv.AppendQuote(b, s)
+}
+
+// Appends v as JSON, bytes being base64-encoded as in OTLP/JSON.
+// Strings use Go's quoting, which only differs from JSON's for invalid UTF-8.
+func appendStructuredValue(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return strconv.AppendQuote(b, v)
+	case bool:
+		return strconv.AppendBool(b, v)
+	case int64:
+		return strconv.AppendInt(b, v, 10)
+	case uint64:
+		return strconv.AppendUint(b, v, 10)
+	case json.Number:
+		return append(b, v...)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return strconv.AppendQuote(b, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+		return strconv.AppendFloat(b, v, 'g', -1, 64)
+	case []byte:
+		b = append(b, '"')
+		b = base64.StdEncoding.AppendEncode(b, v)
+		return append(b, '"')
+	case []any:
+		b = append(b, '[')
+		for i, item := range v {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = appendStructuredValue(b, item)
+		}
+		return append(b, ']')
+	case map[string]any:
+		return appendStructuredValue(b, sortedFields(v))
+	case []KeyValue:
+		b = append(b, '{')
+		for i, kv := range v {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = strconv.AppendQuote(b, kv.key)
+			b = append(b, ':')
+			b = appendStructuredValue(b, kv.value)
+		}
+		return append(b, '}')
+	}
+	return append(b, "null"...)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Optional first line sent by producers connecting to a [ListenAddress]
+// without a capture id, followed by the id to capture into.
+const HANDSHAKE_PREFIX string = "logyard-id:"
+
+// Max size of a datagram, as read from packet connections.
+const MAX_DATAGRAM_SIZE int = 64 << 10
+
+// An address to accept producers on, see [CaptureConfig.listen].
+//
+// Written as "<network>://<address>", such as "tcp://host:port" or
+// "unix:///path/to/socket", optionally followed by "=id" to capture every
+// connection into that id, where the protocol allows it. Otherwise,
+// each connection names its own id with a [HANDSHAKE_PREFIX] line,
+// falling back to [CaptureConfig.captureId].
+type ListenAddress struct {
+	network string
+	address string
+	id      string
+}
+
+func (a ListenAddress) String() string {
+	return a.network + "://" + a.address
+}
+
+// Parses a comma-separated list of addresses over one of networks.
+// routed tells whether addresses may be followed by a capture id.
+func parseListenAddresses(v string, routed bool, networks ...string) ([]ListenAddress, error) {
+	var addrs []ListenAddress
+	for raw := range strings.SplitSeq(v, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		var a ListenAddress
+		rest, id, hasId := strings.Cut(raw, "=")
+		if hasId && !routed {
+			return nil, fmt.Errorf("listen address %q: capture ids can't be chosen by address", raw)
+		}
+		if hasId {
+			if err := validateCaptureId(id); err != nil {
+				return nil, fmt.Errorf("listen address %q: %w", raw, err)
+			}
+			a.id = id
+		}
+		network, address, ok := strings.Cut(rest, "://")
+		if !ok || address == "" || !slices.Contains(networks, network) {
+			return nil, fmt.Errorf("invalid listen address %q: must be \"<network>://<address>\", where network is one of %q", raw, networks)
+		}
+		a.network, a.address = network, address
+		addrs = append(addrs, a)
+	}
+	return addrs, nil
+}
+
+func validateCaptureListen(v string) error {
+	_, err := parseListenAddresses(v, true, "tcp", "unix")
+	return err
+}
+
+// Accepts producers on any number of addresses, writing what
+// they send into the capture files of their ids.
+type CaptureListener struct {
+	g     *Globals
+	files *CaptureFiles
+	// Listeners and packet connections, closed first on shutdown.
+	closers []io.Closer
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	// Set by [CaptureListener.closeListeners], connections accepted afterwards are closed.
+	closed bool
+	// Waits for every connection and packet reader.
+	wg sync.WaitGroup
+}
+
+func newCaptureListener(g *Globals) *CaptureListener {
+	return &CaptureListener{
+		g:     g,
+		files: newCaptureFiles(g),
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// Listens on a, removing stale Unix sockets.
+func (cl *CaptureListener) listen(a ListenAddress) (net.Listener, error) {
+	if a.network == "unix" {
+		// Left over by a process that didn't exit cleanly.
+		if info, err := os.Lstat(a.address); err == nil && info.Mode()&fs.ModeSocket != 0 {
+			os.Remove(a.address)
+		}
+	}
+	l, err := net.Listen(a.network, a.address)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s: %w", a, err)
+	}
+	cl.closers = append(cl.closers, l)
+	return l, nil
+}
+
+func (cl *CaptureListener) listenPacket(a ListenAddress) (net.PacketConn, error) {
+	pc, err := net.ListenPacket(a.network, a.address)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s: %w", a, err)
+	}
+	cl.closers = append(cl.closers, pc)
+	return pc, nil
+}
+
+// Accepts connections on l until it's closed, serving each on a goroutine of its own.
+// Failed accepts, such as when running out of file descriptors, are retried
+// with an increasing delay, as in [net/http.Server.Serve].
+func (cl *CaptureListener) accept(l net.Listener, a ListenAddress, serve func(conn net.Conn, a ListenAddress)) {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+			log.Printf("Accept error on %s, retrying in %s: %+v", a, delay, err)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		cl.mu.Lock()
+		if cl.closed {
+			// Raced with a shutdown, which may already be waiting on the rest.
+			cl.mu.Unlock()
+			conn.Close()
+			return
+		}
+		cl.conns[conn] = struct{}{}
+		cl.wg.Add(1)
+		cl.mu.Unlock()
+		go func() {
+			defer func() {
+				conn.Close()
+				cl.mu.Lock()
+				delete(cl.conns, conn)
+				cl.mu.Unlock()
+				cl.wg.Done()
+			}()
+			serve(conn, a)
+		}()
+	}
+}
+
+// Reads datagrams from pc until it's closed. p is only valid until handle returns.
+func (cl *CaptureListener) readPackets(pc net.PacketConn, a ListenAddress, handle func(p []byte, from net.Addr)) {
+	cl.wg.Add(1)
+	go func() {
+		defer cl.wg.Done()
+		buf := make([]byte, MAX_DATAGRAM_SIZE)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Printf("Read error on %s: %+v", a, err)
+				continue
+			}
+			handle(buf[:n], from)
+		}
+	}()
+}
+
+// Writes a line into the capture file of id.
+func (cl *CaptureListener) write(id string, line []byte) error {
+	f, err := cl.files.get(id)
+	if err != nil {
+		return err
+	}
+	defer cl.files.release(f)
+	_, err = f.w.Write(line)
+	return err
+}
+
+// Waits for a shutdown request, then stops accepting producers and waits
+// for connected ones to disconnect, for up to [BaseConfig.shutdownTimeout].
+// Capture files are closed last.
+func (cl *CaptureListener) run() error {
+	<-cl.g.shutdown
+	cl.closeListeners()
+	if n := cl.count(); n > 0 {
+		log.Printf("Shutting down, waiting for %d producers to disconnect.", n)
+	}
+	ctx, cancel := cl.g.shutdownContext()
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		cl.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Closing %d producers still connected.", cl.count())
+		cl.closeConns()
+		<-done
+	}
+	return cl.files.Close()
+}
+
+func (cl *CaptureListener) closeListeners() {
+	cl.mu.Lock()
+	cl.closed = true
+	cl.mu.Unlock()
+	for _, c := range cl.closers {
+		c.Close()
+	}
+}
+
+func (cl *CaptureListener) count() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return len(cl.conns)
+}
+
+func (cl *CaptureListener) closeConns() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for conn := range cl.conns {
+		conn.Close()
+	}
+}
+
+// Captures connections on [CaptureConfig.listen] instead of reading STDIN,
+// until a shutdown is requested.
+func listenCaptures(g *Globals) error {
+	addrs, err := parseListenAddresses(g.listen, true, "tcp", "unix")
+	if err != nil {
+		return err
+	}
+	cl := newCaptureListener(g)
+	for _, a := range addrs {
+		l, err := cl.listen(a)
+		if err != nil {
+			cl.closeListeners()
+			return err
+		}
+		log.Printf("Accepting producers on %s.", a)
+		go cl.accept(l, a, cl.serveLines)
+	}
+	return cl.run()
+}
+
+// Captures the lines sent through conn, see [ListenAddress].
+func (cl *CaptureListener) serveLines(conn net.Conn, a ListenAddress) {
+	peer := peerName(conn, a)
+	r := bufio.NewReaderSize(conn, LINE_BUFFER_SIZE)
+	id := a.id
+	// A first line that isn't a handshake is captured like any other.
+	var first []byte
+	if id == "" {
+		line, err := r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull && len(line) == 0 {
+			return
+		}
+		if v, ok := bytes.CutPrefix(line, []byte(HANDSHAKE_PREFIX)); ok {
+			id = string(bytes.TrimSpace(v))
+		} else {
+			id = cl.g.captureId
+			first = bytes.Clone(line)
+		}
+	}
+	f, err := cl.files.get(id)
+	if err != nil {
+		log.Printf("[%s] Rejected: %+v", peer, err)
+		return
+	}
+	defer cl.files.release(f)
+	log.Printf("[%s] Connected, capturing into %q.", peer, id)
+	w := f.writer(&cl.g.CaptureConfig, "")
+	if len(first) > 0 {
+		if _, err := w.Write(first); err != nil {
+			log.Printf("[%s] Capture error: %+v", peer, err)
+			return
+		}
+	}
+	if err := copyLines(r, w); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("[%s] Capture error: %+v", peer, err)
+		return
+	}
+	log.Printf("[%s] Disconnected.", peer)
+}
+
+// Names the remote end of conn in logs. Unix sockets have no remote address.
+func peerName(conn net.Conn, a ListenAddress) string {
+	if peer := conn.RemoteAddr().String(); peer != "" && peer != "@" {
+		return peer
+	}
+	return a.String()
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestParseListenAddresses(t *testing.T) {
+	tests := []struct {
+		in     string
+		routed bool
+		want   []ListenAddress
+		err    bool
+	}{
+		{"", true, nil, false},
+		{"tcp://:9000", true, []ListenAddress{{"tcp", ":9000", ""}}, false},
+		{" tcp://:9000=web, unix:///tmp/a.sock ,", true,
+			[]ListenAddress{{"tcp", ":9000", "web"}, {"unix", "/tmp/a.sock", ""}}, false},
+		{"tcp://:9000=web", false, nil, true},
+		{"tcp://:9000=../web", true, nil, true},
+		{"tcp://:9000=", true, nil, true},
+		{":9000", true, nil, true},
+		{"tcp://", true, nil, true},
+		{"udp://:9000", true, nil, true},
+		{"tcp://:9000,udp://:9000", true, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseListenAddresses(tt.in, tt.routed, "tcp", "unix")
+		if (err != nil) != tt.err {
+			t.Errorf("parseListenAddresses(%q, %t): error %v, want error: %t", tt.in, tt.routed, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseListenAddresses(%q, %t) = %+v, want %+v", tt.in, tt.routed, got, tt.want)
+		}
+	}
+}
+
+// Returns a listener capturing into a new directory, falling back to the "default" id.
+func newTestCaptureListener(t *testing.T) *CaptureListener {
+	t.Helper()
+	g := &Globals{GlobalConfig: &GlobalConfig{}}
+	g.capturePath = t.TempDir()
+	g.captureId = "default"
+	return newCaptureListener(g)
+}
+
+func TestServeLines(t *testing.T) {
+	tests := []struct {
+		name string
+		// The capture id of the address, if any.
+		id   string
+		sent string
+		want map[string]string
+	}{
+		{"handshake", "", "logyard-id: web \nhello\nworld\n", map[string]string{"web.log": "hello\nworld\n"}},
+		{"no handshake", "", "hello\nworld", map[string]string{"default.log": "hello\nworld"}},
+		{"id of the address", "api", "logyard-id: web\nhello\n", map[string]string{"api.log": "logyard-id: web\nhello\n"}},
+		{"invalid id", "", "logyard-id: ../web\nhello\n", map[string]string{}},
+		{"nothing sent", "", "", map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cl := newTestCaptureListener(t)
+			client, server := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				defer server.Close()
+				cl.serveLines(server, ListenAddress{"tcp", ":9000", tt.id})
+			}()
+			if tt.sent != "" {
+				// Fails once a rejected producer is disconnected.
+				io.WriteString(client, tt.sent)
+			}
+			client.Close()
+			<-done
+			if err := cl.files.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := readFiles(t, cl.g.capturePath); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeLinesSharedFile(t *testing.T) {
+	cl := newTestCaptureListener(t)
+	l, err := cl.listen(ListenAddress{"tcp", "127.0.0.1:0", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := ListenAddress{"tcp", l.Addr().String(), "shared"}
+	go cl.accept(l, a, cl.serveLines)
+
+	const producers, lines = 4, 100
+	var want []string
+	for p := range producers {
+		for i := range lines {
+			want = append(want, fmt.Sprintf("%d %d\n", p, i))
+		}
+	}
+	var wg sync.WaitGroup
+	for p := range producers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", a.address)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			w := bufio.NewWriter(conn)
+			for _, line := range want[p*lines : (p+1)*lines] {
+				w.WriteString(line)
+			}
+			if err := w.Flush(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	// Sent, but maybe not accepted yet.
+	path := filepath.Join(cl.g.capturePath, "shared.log")
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if info, err := os.Stat(path); err == nil && info.Size() >= int64(len(strings.Join(want, ""))) {
+			break
+		}
+	}
+	cl.closeListeners()
+	cl.wg.Wait()
+	if err := cl.files.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := slices.Sorted(strings.Lines(string(b)))
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("captured lines cut or lost:\n%s", b)
+	}
+}
+
+// Records each write it receives.
+type writesRecorder struct {
+	writes []string
+	err    error
+}
+
+func (r *writesRecorder) Write(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	r.writes = append(r.writes, string(p))
+	return len(p), nil
+}
+
+func TestCopyLines(t *testing.T) {
+	// The smallest buffer bufio allows.
+	const size = 16
+	long := strings.Repeat("x", size+4) + "\n"
+	var w writesRecorder
+	r := bufio.NewReaderSize(strings.NewReader("a\nb\r\n"+long+"c"), size)
+	if err := copyLines(r, &w); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a\n", "b\r\n", long[:size], long[size:], "c"}
+	if !reflect.DeepEqual(w.writes, want) {
+		t.Errorf("got %q, want %q", w.writes, want)
+	}
+
+	failed := errors.New("disk full")
+	err := copyLines(bufio.NewReader(strings.NewReader("a\n")), &writesRecorder{err: failed})
+	var werr *WriteError
+	if !errors.As(err, &werr) || !errors.Is(err, failed) {
+		t.Errorf("error %v, want a write error", err)
+	}
+	err = copyLines(bufio.NewReader(iotest.ErrReader(failed)), &w)
+	if errors.As(err, &werr) || !errors.Is(err, failed) {
+		t.Errorf("error %v, want the read error", err)
+	}
+}
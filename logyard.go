@@ -1,15 +1,14 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"context"
 	_ "embed"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	"os"
@@ -18,6 +17,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -49,10 +49,36 @@ type BaseConfig struct {
 	captureLogs  bool // Whether the process should write its own logs to a capture file.
 	rolling      bool // Whether log files should be cycled after exceeding [logChunkMb].
 	logChunkSize int  // Max rolling log file size, in megabytes.
+	// Whether rolling log files are also cycled every hour or day,
+	// whichever comes first. Either [ROTATE_HOURLY], [ROTATE_DAILY] or empty.
+	rotation string
+	// Rotated chunks kept per rolling set. Non-positive values keep them all.
+	maxBackups int
+	// Days rotated chunks are kept for. Non-positive values keep them forever.
+	maxAge int
+	// Max size of each rolling set, its active file and chunks, in megabytes.
+	// The oldest chunks of the set are removed to stay within it.
+	//
+	// Non-positive values disable the limit.
+	diskBudget int
+	// Whether rotated chunks are compressed with gzip.
+	compress bool
+	// The configuration file provided by the user. If empty,
+	// [CONFIG_FILE_NAME] is looked up in [homePath] instead.
+	configPath string
+	// Whether the process should print the effective configuration and exit.
+	dumpConfig bool
+	// The name of the command being run, see [commands].
+	command string
+	// Positional arguments, for commands that take them. See [Command.args].
+	args []string
+	// How long commands may take to stop gracefully on shutdown, in milliseconds.
+	//
+	// Non-positive values wait indefinitely.
+	shutdownTimeout int
 }
 
 type DemoConfig struct {
-	demo bool // Whether the process should run in demo mode.
 	// Amount of lines to print in demo mode.
 	//
 	// Non-positive values print until the process is manually terminated.
@@ -62,13 +88,51 @@ type DemoConfig struct {
 }
 
 type CaptureConfig struct {
-	capture bool // Whether the process should run in capture mode.
 	// Acts as namespace for capture files.
 	// May be reused by modes other than capture,
 	// to avoid name collisions in general.
 	captureId string
 	// Where capture files are created.
 	capturePath string
+	// Layout of the timestamp prefixed to captured lines, see [timestampFormats].
+	// Empty to leave lines untouched.
+	timestampFormat string
+	// Either [TIMESTAMP_UTC] or [TIMESTAMP_LOCAL].
+	timestampZone string
+	// Whether captured lines are prefixed with their sequence number, starting from 1.
+	sequence bool
+	// Where captured input is also written to, unprefixed. Either [TEE_STDOUT],
+	// [TEE_STDERR] or empty to only write the capture file.
+	tee string
+	// Comma-separated [ListenAddress] list to accept producers on, instead of reading STDIN.
+	listen string
+}
+
+type SuperviseConfig struct {
+	// Whether the standard output and error of the command are captured
+	// into separate files, instead of a single one tagging each line.
+	split bool
+	// When the command is started again after exiting. One of
+	// [RESTART_NEVER], [RESTART_ON_FAILURE] or [RESTART_ALWAYS].
+	restart string
+	// Milliseconds to wait before restarting the command.
+	restartDelay int
+	// Restarts allowed before giving up.
+	//
+	// Non-positive values allow any number of restarts.
+	maxRestarts int
+}
+
+type IngestConfig struct {
+	// Comma-separated [ListenAddress] list to receive syslog messages on, over UDP or TCP.
+	syslog string
+	// How syslog messages are split into capture files. One of
+	// [PARTITION_HOST], [PARTITION_APP] or [PARTITION_HOST_APP].
+	syslogPartition string
+	// Comma-separated [ListenAddress] list to receive GELF messages on, over UDP or TCP.
+	gelf string
+	// Comma-separated [ListenAddress] list to receive Fluent Forward events on, over TCP or Unix sockets.
+	forward string
 }
 
 type ServerConfig struct {
@@ -76,15 +140,50 @@ type ServerConfig struct {
 	// Polling interval when streaming files in polling mode.
 	// In milliseconds.
 	pollingInterval int
+	// How streams detect changes to the files they follow.
+	// Either [FOLLOW_AUTO] or [FOLLOW_POLLING].
+	followMode string
 	// Paths to scan for log files, provided by the user as a comma-separated list.
 	sourcePaths string
+	// Interval between background re-scans of [sourcePaths], in milliseconds.
+	//
+	// Non-positive values disable re-scanning.
+	rescanInterval int
+	// Max size of a message carrying several lines, in kilobytes.
+	//
+	// Non-positive values send every line on its own.
+	batchSize int
+	// How long a batch may wait for more lines before being sent, in milliseconds.
+	//
+	// Non-positive values send batches as soon as the queue is empty.
+	batchDelay int
+	// Messages waiting to be written to a client before it's considered to fall behind.
+	sendQueue int
+	// What to do with clients that fall behind. One of [SLOW_CLIENT_BLOCK],
+	// [SLOW_CLIENT_DROP] or [SLOW_CLIENT_DISCONNECT].
+	slowClient string
+	// Time allowed for a single write to a client, in milliseconds.
+	//
+	// Non-positive values disable the deadline.
+	writeTimeout int
+	// Interval between pings to clients, in milliseconds. Clients that don't
+	// answer within [pingInterval] plus [writeTimeout] are disconnected.
+	//
+	// Non-positive values disable pings.
+	pingInterval int
+	// Whether lines may be pushed to "/ingest/<id>", see [handlePush],
+	// and OpenTelemetry logs exported to [OTLP_LOGS_PATH], see [handleOtlpLogs].
+	// [capturePath] is scanned for sources too while enabled.
+	push bool
 }
 
-// Wrapper for flag variables, bound by [parseFlags]
+// Wrapper for flag variables, bound by [GlobalConfig.parseArgs]
 type GlobalConfig struct {
 	BaseConfig
 	ServerConfig
 	CaptureConfig
+	SuperviseConfig
+	IngestConfig
 	DemoConfig
 }
 
@@ -94,45 +193,155 @@ func getDefaultCaptureID(now time.Time) string {
 	return fmt.Sprintf("%d", secOfYear)
 }
 
-func (c *GlobalConfig) parseFlags() {
-	_DEFAULT_ID := getDefaultCaptureID(time.Now().UTC())
-
-	// base
-	flag.StringVar(&c.homePath, "hdir", "",
+// Registers the flags shared by every command.
+func (c *GlobalConfig) baseFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.homePath, "hdir", "",
 		"The home directory for Logyard "+
 			"(aliased as \"app://\" in other user-provided paths). "+
 			"If empty, the installation directory will be used.")
-	flag.BoolVar(&c.logging, "l", false, "Enable Logyard's own logging to stderr.")
-	flag.BoolVar(&c.captureLogs, "cl", false, "Enable Logyard's own logging directly into a capture file.")
-	flag.BoolVar(&c.rolling, "rl", false, "Enable rolling logs. Also applies to captures. Does not enable logging by itself.")
-	flag.IntVar(&c.logChunkSize, "chunkmb", 10, "Max rolling log file size, in megabytes.")
-	// server mode
-	flag.IntVar(&c.port, "port", DEFAULT_PORT, "The port for the web UI. Server mode only.")
-	flag.IntVar(&c.pollingInterval, "polling", 2000, "Polling interval when using polling mode to stream a file'. Server mode only.")
-	flag.StringVar(&c.sourcePaths, "src", DEFAULT_CAPTURE_DIR, "A comma-separated list of paths to scan for log files. "+
-		"May contain directories or specific files. Directories are always scanned recursively. Server mode only.")
-	// capture mode
-	flag.StringVar(&c.captureId, "id", _DEFAULT_ID,
+	fs.BoolVar(&c.logging, "l", false, "Enable Logyard's own logging to stderr.")
+	fs.StringVar(&c.configPath, "config", "", "A JSON configuration file. Flags take precedence over its values. "+
+		"If empty, \""+HOME_DIR_SYMBOL+CONFIG_FILE_NAME+"\" is used when present.")
+	fs.BoolVar(&c.dumpConfig, "dumpconfig", false, "Print the effective configuration as JSON and exit.")
+	fs.IntVar(&c.shutdownTimeout, "shutdown", 5000, "Milliseconds allowed to stop gracefully on SIGINT or SIGTERM, "+
+		"closing streams and flushing capture files. A second signal exits right away. Non-positive values wait indefinitely.")
+}
+
+// Registers the flags of capture files and Logyard's own capture file,
+// shared by the commands that write them.
+func (c *GlobalConfig) captureFileFlags(fs *flag.FlagSet) {
+	_DEFAULT_ID := getDefaultCaptureID(time.Now().UTC())
+
+	fs.BoolVar(&c.captureLogs, "cl", false, "Enable Logyard's own logging directly into a capture file.")
+	fs.BoolVar(&c.rolling, "rl", false, "Enable rolling logs. Also applies to captures. Does not enable logging by itself.")
+	fs.IntVar(&c.logChunkSize, "chunkmb", 10, "Max rolling log file size, in megabytes. "+
+		"Non-positive values disable rotation by size.")
+	fs.StringVar(&c.rotation, "rotate", "", "Also cycle rolling log files every hour or day (in UTC), whichever comes first: "+
+		"\""+ROTATE_HOURLY+"\" or \""+ROTATE_DAILY+"\". Empty to cycle by size only.")
+	fs.IntVar(&c.maxBackups, "maxbackups", 0, "Rotated chunks kept per rolling log file. Non-positive values keep them all.")
+	fs.IntVar(&c.maxAge, "maxage", 0, "Days rotated chunks are kept for, based on their name. Non-positive values keep them forever.")
+	fs.IntVar(&c.diskBudget, "maxdiskmb", 0, "Max size in megabytes of the rolling log files in each capture directory, "+
+		"removing the oldest rotated chunks to stay within it. Non-positive values disable the limit.")
+	fs.BoolVar(&c.compress, "compress", false, "Compress rotated chunks with gzip.")
+	// Also used for Logyard's own logs with -cl.
+	fs.StringVar(&c.captureId, "id", _DEFAULT_ID,
 		"A unique identifier for the generated file(s). The default value is the UTC second of the current year, computed on startup.")
-	flag.BoolVar(&c.capture, "c", false, "Toggle capture mode.")
-	flag.StringVar(&c.capturePath, "cdir", DEFAULT_CAPTURE_DIR, "The directory where capture files are created. Capture mode only.")
-	// demo mode
-	flag.BoolVar(&c.demo, "d", false, "Toggle demo mode.")
-	flag.IntVar(&c.demoLines, "demo", -1, "A number of lines to print before exiting demo mode. "+
+	fs.StringVar(&c.capturePath, "cdir", DEFAULT_CAPTURE_DIR, "The directory where capture files are created.")
+}
+
+func (c *GlobalConfig) serverFlags(fs *flag.FlagSet) {
+	// For -push and -cl.
+	c.captureFileFlags(fs)
+	fs.IntVar(&c.port, "port", DEFAULT_PORT, "The port for the web UI.")
+	fs.IntVar(&c.pollingInterval, "polling", 2000, "Polling interval when using polling mode to stream a file'.")
+	fs.StringVar(&c.followMode, "follow", FOLLOW_AUTO, "How streamed files are followed: \""+FOLLOW_AUTO+"\" uses file system events "+
+		"where supported (Linux), falling back to polling; \""+FOLLOW_POLLING+"\" always polls every -polling milliseconds.")
+	fs.StringVar(&c.sourcePaths, "src", DEFAULT_CAPTURE_DIR, "A comma-separated list of paths to scan for log files. "+
+		"May contain directories or specific files. Directories are always scanned recursively.")
+	fs.IntVar(&c.rescanInterval, "rescan", 5000, "Interval in milliseconds between re-scans of the source paths, "+
+		"picking up log files created or deleted while the server runs. Non-positive values disable re-scanning.")
+	fs.IntVar(&c.batchSize, "batchkb", 32, "Max size in kilobytes of a WebSocket message carrying several lines. "+
+		"Non-positive values send every line in a message of its own.")
+	fs.IntVar(&c.batchDelay, "batchms", 20, "Milliseconds a batch of lines may wait for more lines before being sent. "+
+		"Non-positive values send batches as soon as no more lines are waiting.")
+	fs.IntVar(&c.sendQueue, "queue", 1024, "Number of messages waiting to be sent to a client before it's considered to fall behind.")
+	fs.StringVar(&c.slowClient, "slow", SLOW_CLIENT_BLOCK, "What to do when a client falls behind: \""+SLOW_CLIENT_BLOCK+"\" waits for it, "+
+		"\""+SLOW_CLIENT_DROP+"\" skips lines and reports how many, \""+SLOW_CLIENT_DISCONNECT+"\" closes the connection.")
+	fs.IntVar(&c.writeTimeout, "wtimeout", 10000, "Milliseconds allowed for a single write to a client. "+
+		"Non-positive values disable the deadline.")
+	fs.IntVar(&c.pingInterval, "ping", 30000, "Interval in milliseconds between pings to clients. Clients that don't answer "+
+		"within this interval plus -wtimeout are disconnected. Non-positive values disable pings.")
+	fs.BoolVar(&c.push, "push", false, "Accept lines pushed with \"POST /ingest/<id>\", as newline-delimited text or NDJSON, "+
+		"and OpenTelemetry logs exported over OTLP/HTTP to \""+OTLP_LOGS_PATH+"\", keyed by service.name. "+
+		"Lines are appended to capture files under -cdir, which is then also scanned for log files.")
+}
+
+func (c *GlobalConfig) captureFlags(fs *flag.FlagSet) {
+	c.captureFileFlags(fs)
+	c.prefixFlags(fs)
+	fs.StringVar(&c.tee, "tee", "", "Also pass input through, unprefixed, to \""+TEE_STDOUT+"\" or \""+TEE_STDERR+"\", "+
+		"so that capture can sit in the middle of a pipeline. Empty to only write the capture file.")
+	fs.StringVar(&c.listen, "listen", "", "A comma-separated list of addresses to accept producers on, instead of reading STDIN: "+
+		"\"tcp://host:port\" or \"unix:///path\", optionally followed by \"=id\" to capture every connection into that id. "+
+		"Otherwise, connections may send \""+HANDSHAKE_PREFIX+" <id>\" as their first line, falling back to -id.")
+}
+
+func (c *GlobalConfig) superviseFlags(fs *flag.FlagSet) {
+	c.captureFileFlags(fs)
+	c.prefixFlags(fs)
+	fs.BoolVar(&c.split, "split", false, "Capture standard output and error into separate files, "+
+		"suffixed \"-stdout\" and \"-stderr\", instead of a single one tagging each line with its stream.")
+	fs.StringVar(&c.restart, "restart", RESTART_NEVER, "When to start the command again after it exits: \""+RESTART_NEVER+"\", "+
+		"\""+RESTART_ON_FAILURE+"\" (non-zero exit codes and signals) or \""+RESTART_ALWAYS+"\".")
+	fs.IntVar(&c.restartDelay, "restartms", 1000, "Milliseconds to wait before restarting the command.")
+	fs.IntVar(&c.maxRestarts, "maxrestarts", 0, "Restarts allowed before giving up. Non-positive values allow any number of restarts.")
+}
+
+// Registers the flags prefixing captured lines, shared by the commands that capture.
+func (c *GlobalConfig) prefixFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.timestampFormat, "ts", "", "Prefix each captured line with the time it was received, in this format: "+
+		"\"rfc3339\", \"rfc3339ms\", \"rfc3339nano\", \"unix\" (seconds), \"unixms\" or a Go time layout. Empty to disable.")
+	fs.StringVar(&c.timestampZone, "tz", TIMESTAMP_UTC, "The time zone of -ts timestamps: \""+TIMESTAMP_UTC+"\" or \""+TIMESTAMP_LOCAL+"\".")
+	fs.BoolVar(&c.sequence, "seq", false, "Prefix each captured line with its sequence number, after the -ts timestamp if any.")
+}
+
+func (c *GlobalConfig) ingestFlags(fs *flag.FlagSet) {
+	c.captureFileFlags(fs)
+	fs.StringVar(&c.syslog, "syslog", "", "A comma-separated list of addresses to receive RFC 3164 and RFC 5424 syslog messages on: "+
+		"\"udp://host:port\" or \"tcp://host:port\". TCP accepts both octet-counted and newline-delimited messages.")
+	fs.StringVar(&c.syslogPartition, "partition", PARTITION_HOST_APP, "How syslog messages are split into capture files: "+
+		"by \""+PARTITION_HOST+"\", \""+PARTITION_APP+"\" or \""+PARTITION_HOST_APP+"\".")
+	fs.StringVar(&c.gelf, "gelf", "", "A comma-separated list of addresses to receive GELF messages on, as sent by Docker's gelf log driver: "+
+		"\"udp://host:port\" for chunked and compressed datagrams, or \"tcp://host:port\" for NUL-delimited messages. "+
+		"Messages are captured into a file per container, falling back to their tag, then host.")
+	fs.StringVar(&c.forward, "forward", "", "A comma-separated list of addresses to receive Fluent Forward events on, as sent by Docker's fluentd log driver "+
+		"and Fluentd or Fluent Bit forward outputs: \"tcp://host:port\" or \"unix:///path/to/socket\". "+
+		"Events are captured into a file per container, falling back to their tag.")
+}
+
+func (c *GlobalConfig) demoFlags(fs *flag.FlagSet) {
+	fs.IntVar(&c.demoLines, "lines", -1, "A number of lines to print before exiting. "+
 		"Non-positive values (zero or less) will print until the process is manually terminated.")
-	flag.IntVar(&c.maxDemoSleep, "maxDemoInterval", 500,
+	fs.IntVar(&c.maxDemoSleep, "maxDemoInterval", 500,
 		"The maximum number of milliseconds to sleep between demo logs. "+
 			"The actual time is randomized between prints, following a uniform distribution.")
-	flag.Parse()
 }
 
 type Globals struct {
 	*GlobalConfig
-	shutdown chan int
+	// The flags of the command being run, holding the effective configuration.
+	flags *flag.FlagSet
+	// Receives the signal that requested a shutdown, or zero, at most once.
+	// Every command is expected to stop gracefully upon receiving it.
+	// See [Globals.requestShutdown].
+	shutdown chan syscall.Signal
+	stopping atomic.Bool
+	// Run right before exiting on a second signal, to kill processes
+	// that would otherwise outlive Logyard. Optional.
+	forceExit atomic.Pointer[func()]
+	// Logyard's own capture file, nil unless [captureLogs] is set.
+	logCapture *LogCapture
 }
 
 type ServerResources struct {
 	g *Globals
+	// The live copy of [Globals.ServerConfig], replaced as a whole
+	// when the configuration is reloaded. See [ServerResources.config].
+	cfg atomic.Pointer[ServerConfig]
+	// Receives a value when the configuration must be reloaded.
+	reload chan struct{}
+	// Receives a value when the sources must be re-scanned right away,
+	// see [ServerResources.requestRescan].
+	rescan chan struct{}
+	// Closed once the requested re-scan is done.
+	rescanMu      sync.Mutex
+	rescanWaiters []chan struct{}
+	// Capture files receiving pushed lines, see [handlePush].
+	ingest *CaptureFiles
+	// Push requests currently running, see [ServerResources.beginPush].
+	pushMu     sync.Mutex
+	pushClosed bool
+	pushWg     sync.WaitGroup
 	// A copy of [indexHTML] with the currently known sources
 	// listed at the <!--SOURCES--> placeholder.
 	cachedHome atomic.Pointer[[]byte]
@@ -141,10 +350,32 @@ type ServerResources struct {
 	// The logger for "server mode" routines.
 	log *log.Logger
 	// Descriptors for all the sources listed in [sourcePaths].
+	//
+	// Owned by [watchSources] once the server starts.
 	rawSources []RawSourceDescriptor
 	// Descriptors for all the valid sources in "allSources" that
 	// can be listed for viewing.
+	//
+	// Owned by [refreshSources], readers should use [endpoints] instead.
 	validSources []ValidSourceDescriptor
+	// Viewable sources keyed by their "/src/..." endpoint path.
+	// Replaced as a whole on every refresh.
+	endpoints atomic.Pointer[map[string]*SourceEndpoint]
+	// Shared file system watcher for streams. Nil when polling.
+	watcher *Watcher
+	// Streams currently running, see [ServerResources.stopStreams].
+	streamsMu sync.Mutex
+	streams   map[*Stream]struct{}
+	// Set by [ServerResources.closeStreams], no stream may start afterwards.
+	streamsClosed bool
+	// Waits for every stream to end.
+	streamsWg sync.WaitGroup
+}
+
+// Returns the current server configuration. Must be used instead of
+// [Globals.ServerConfig] by every server routine, since it may be reloaded.
+func (sr *ServerResources) config() *ServerConfig {
+	return sr.cfg.Load()
 }
 
 // Describes a user-provided source path.
@@ -173,12 +404,26 @@ type ValidSourceDescriptor struct {
 	// said directory and its descendants. Intermediate
 	// directories are ignored.
 	sub *[]ValidSourceDescriptor
+	// If a ValidSourceDescriptor points to the active file of
+	// a rolling set, chunks contains its rotated backups,
+	// oldest first. Together they make a single logical source.
+	chunks []ValidSourceDescriptor
+}
+
+// A log file that can be viewed and streamed under "/src/...".
+type SourceEndpoint struct {
+	// The endpoint path, without the trailing "/$" used for streaming.
+	path string
+	vsd  *ValidSourceDescriptor
+	// A copy of [viewerHTML] for this source.
+	document []byte
 }
 
 type Initializer struct {
 	GlobalConfig
 	logTempBuffer *bytes.Buffer
 	logOutput     io.Writer
+	logCapture    *LogCapture
 }
 
 func (i *Initializer) initHomePath() error {
@@ -216,7 +461,7 @@ func (i *Initializer) swapLoggerOutput() {
 }
 
 func (i *Initializer) initCaptureDir() error {
-	if i.capture || i.captureLogs {
+	if i.command == COMMAND_CAPTURE || i.command == COMMAND_RUN || i.command == COMMAND_INGEST || i.captureLogs {
 		err := os.MkdirAll(i.capturePath, 0755)
 		if err != nil {
 			return fmt.Errorf("create directory: %w", err)
@@ -228,39 +473,61 @@ func (i *Initializer) initCaptureDir() error {
 func (i *Initializer) initLogCapture() (err error) {
 	if i.captureLogs {
 		path := filepath.Join(i.capturePath, fmt.Sprintf("%s-%s.log", i.captureId, LOG_FILE_NAME))
-		if i.rolling {
-			i.logOutput = getRollingLogger(path, i.logChunkSize)
-		} else {
-			lf, err := os.Create(path)
-			if err != nil {
-				return fmt.Errorf("create log file %q: %w", path, err)
-			}
-			i.logOutput = lf
+		if i.logCapture, err = newLogCapture(path, i.rolling, i.rollingOptions()); err != nil {
+			return err
 		}
+		i.logOutput = i.logCapture
 	}
 	return nil
 }
 
+// Parses args, then applies the environment and the configuration file
+// to the flags that were not set, and validates the result.
+func (i *Initializer) loadConfig(args []string) (*flag.FlagSet, error) {
+	fs, err := i.parseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	// Before anything else, the environment may move the home path.
+	if applied, err := applyEnv(fs); err != nil {
+		return nil, err
+	} else if len(applied) > 0 {
+		log.Printf("Applied environment variables: %s", strings.Join(applied, ", "))
+	}
+	if err := i.initHomePath(); err != nil {
+		return nil, fmt.Errorf("initialize home path: %w", err)
+	}
+	if path, err := i.loadConfigFile(fs); err != nil {
+		return nil, fmt.Errorf("load config file: %w", err)
+	} else if path != "" {
+		log.Printf("Loaded config file %q", path)
+	}
+	if err := validateConfig(fs); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
 // TODO: this can only run on the main thread, before starting additional goroutines.
 func (i Initializer) init() (g *Globals, err error) {
-	i.parseFlags()
+	i.initGlobalLogger()
+	defer i.swapLoggerOutput()
+
+	log.Printf("Initializing with args: %+v", os.Args)
+
+	fs, err := i.loadConfig(os.Args[1:])
+	if err != nil {
+		return nil, err
+	}
 	g = &Globals{
 		GlobalConfig: &i.GlobalConfig,
-		shutdown:     make(chan int),
+		flags:        fs,
+		shutdown:     make(chan syscall.Signal, 1),
 	}
-
-	i.initGlobalLogger()
-	defer i.swapLoggerOutput()
 	if i.logging {
 		// TODO: multi-writer when both -l and -cl are present.
 		i.logOutput = os.Stdout
 	}
-
-	log.Printf("Initializing with args: %+v", os.Args)
-
-	if err := i.initHomePath(); err != nil {
-		return g, fmt.Errorf("initialize home path: %w", err)
-	}
 	if err := i.initCapturePath(); err != nil {
 		return g, fmt.Errorf("initialize capture path: %w", err)
 	}
@@ -270,9 +537,10 @@ func (i Initializer) init() (g *Globals, err error) {
 	if err := i.initLogCapture(); err != nil {
 		return g, fmt.Errorf("initialize log capture: %w", err)
 	}
+	g.logCapture = i.logCapture
 
 	log.Printf("Globals initialized. Working under %q", g.homePath)
-	if g.capture || g.captureLogs {
+	if g.command == COMMAND_CAPTURE || g.command == COMMAND_RUN || g.command == COMMAND_INGEST || g.captureLogs {
 		log.Printf("Capture path: %q", g.capturePath)
 	}
 
@@ -281,90 +549,134 @@ func (i Initializer) init() (g *Globals, err error) {
 
 func main() {
 	g, err := Initializer{}.init()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if g.demo {
-		log.Printf("Starting demo mode. Iterations: %d. Sleep: %d", g.demoLines, g.maxDemoSleep)
-		runDemo(g)
-		return
-	}
-	if g.capture {
-		log.Printf("Starting capture mode. Capture id: \"%s\". Home path: \"%s\". Capture path: \"%s\"", g.captureId, g.homePath, g.capturePath)
-		err = startCapture(g)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if errors.Is(err, errInvalidFlags) {
+		// Already printed along with the usage, as the flag package would.
+		os.Exit(2)
+	} else if err != nil {
+		// Logging may be disabled, but these are most likely user errors.
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if g.dumpConfig {
+		b, err := dumpConfig(g.flags)
 		if err != nil {
 			log.Fatal(err)
 		}
+		os.Stdout.Write(b)
 		return
 	}
-	log.Println("Starting server mode.")
-	err = startServer(g)
+	cmd, _ := findCommand(g.command)
+	go handleSignals(g)
+	err = cmd.run(g)
+	if err != nil {
+		log.Print(err)
+		if !g.logging {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	g.logCapture.Close()
 	if err != nil {
-		log.Fatal(err)
+		os.Exit(1)
 	}
 }
 
-func getRollingLogger(filename string, chunkSize int) io.Writer {
+// Returns a [RollingWriter] for filename. Shared is set when
+// its directory also holds files of other captures.
+func getRollingLogger(filename string, opts RollingOptions, shared bool) io.Writer {
 	if !strings.HasSuffix(filename, ".log") {
 		filename += ".log"
 	}
-	var w io.Writer = &lumberjack.Logger{
+	return newRollingWriter(&lumberjack.Logger{
 		Filename: filename,
-		MaxSize:  chunkSize,
-	}
-	return w
+		// Rotated by [RollingWriter] instead.
+		MaxSize:    math.MaxInt32,
+		MaxBackups: max(opts.maxBackups, 0),
+		MaxAge:     max(opts.maxAge, 0),
+		Compress:   opts.compress,
+	}, opts, shared)
 }
 
-func runDemo(g *Globals) {
+func runDemo(g *Globals) error {
+	log.Printf("Starting demo mode. Iterations: %d. Sleep: %d", g.demoLines, g.maxDemoSleep)
 	const format = "Demo log line %d. Sample string: %q"
 	const sample = "this string will appear %d times :)"
+	// Returns false once a shutdown is requested.
+	sleep := func() bool {
+		select {
+		case <-time.After(time.Duration(rand.Intn(g.maxDemoSleep)) * time.Millisecond):
+			return true
+		case <-g.shutdown:
+			log.Print("Ending demo mode.")
+			return false
+		}
+	}
 	if g.demoLines < 1 {
 		i := uint64(0)
-		for {
-			time.Sleep(time.Duration(rand.Intn(g.maxDemoSleep)) * time.Millisecond)
+		for sleep() {
 			n := slices.Min([]int{rand.Intn(12), rand.Intn(12), rand.Intn(12)}) + 1
 			log.Printf(format, i, strings.Join(slices.Repeat([]string{fmt.Sprintf(sample, n)}, n), " "))
 			i++
 		}
 	} else {
 		for i := range g.demoLines {
-			time.Sleep(time.Duration(rand.Intn(g.maxDemoSleep)) * time.Millisecond)
+			if !sleep() {
+				break
+			}
 			n := slices.Min([]int{rand.Intn(12), rand.Intn(12), rand.Intn(12)}) + 1
 			log.Printf(format, i, strings.Join(slices.Repeat([]string{fmt.Sprintf(sample, n)}, n), " "))
 		}
 	}
-
-}
-
-func startCapture(g *Globals) (err error) {
-	var writer io.Writer
-	if g.rolling {
-		path := filepath.Join(g.capturePath, g.captureId, g.captureId)
-		writer = getRollingLogger(path, g.logChunkSize)
-	} else {
-		path := filepath.Join(g.capturePath, g.captureId+".log")
-		log.Printf("Creating capture file: %q", path)
-		f, err := os.Create(path)
-		if err != nil {
-			return fmt.Errorf("failed to create capture file: %+v", err)
-		}
-		writer = f
-	}
-
-	_, err = io.Copy(writer, os.Stdin)
-	return err
+	return nil
 }
 
 func startServer(g *Globals) (err error) {
+	log.Println("Starting server mode.")
 	sr := ServerResources{}
 	sr.g = g
 	sr.log = getLogger("[Server]")
-	sr.log.Printf("Resolving sourcePaths: %q", g.sourcePaths)
+	cfg := g.ServerConfig
+	sr.cfg.Store(&cfg)
+	sr.reload = make(chan struct{}, 1)
+	sr.rescan = make(chan struct{}, 1)
+	sr.ingest = newCaptureFiles(g)
+	resolveSources(&sr)
+	if err := initWatcher(&sr); err != nil {
+		return fmt.Errorf("initialize watcher: %w", err)
+	}
+	refreshSources(&sr, true)
+	go watchSources(&sr)
+	go handleReloads(&sr)
+
+	addr := fmt.Sprintf(":%d", cfg.port)
+	buildServer(&sr, addr)
+	stopped := make(chan error, 1)
+	go func() { stopped <- stopServer(&sr) }()
+
+	sr.log.Printf("Starting server on: %q", addr)
+	err = sr.s.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return err
+	}
+	sr.log.Print("Server returned. Awaiting shutdown.")
+	if err := <-stopped; err != nil {
+		return err
+	}
+	sr.log.Print("Ending server mode.")
+	return nil
+}
+
+// Resolves [ServerConfig.sourcePaths] into [ServerResources.rawSources].
+func resolveSources(sr *ServerResources) {
+	paths := sr.config().sourcePaths
+	sr.log.Printf("Resolving sourcePaths: %q", paths)
 	var resolved []string
-	for str := range strings.SplitSeq(g.sourcePaths, ",") {
+	sr.rawSources = nil
+	for str := range strings.SplitSeq(paths, ",") {
 		var sd RawSourceDescriptor
 		sd.rawPath = str
-		abs, err := resolveAbsolutePath(str, g.homePath)
+		abs, err := resolveAbsolutePath(str, sr.g.homePath)
 		if sd.valid = err == nil; sd.valid {
 			sd.absPath = abs
 			resolved = append(resolved, abs)
@@ -373,59 +685,58 @@ func startServer(g *Globals) (err error) {
 		}
 		sr.rawSources = append(sr.rawSources, sd)
 	}
-	sr.log.Printf("Resolved sources: %q", resolved)
-	statSources(&sr)
-	buildHome(&sr)
-
-	addr := fmt.Sprintf(":%d", g.port)
-	shutdown := buildServer(&sr, addr)
-
-	sr.log.Printf("Starting server on: %q", addr)
-	err = sr.s.ListenAndServe()
-	if err != http.ErrServerClosed {
-		return err
-	}
-	sr.log.Print("Server returned. Awaiting shutdown signal.")
-	_, ok := <-shutdown
-	if !ok {
-		return errors.New("shutdown channel closed before receiving shutdown signal")
+	if sr.needsCaptureSource() {
+		sr.rawSources = append(sr.rawSources, RawSourceDescriptor{rawPath: sr.g.capturePath, absPath: sr.g.capturePath, valid: true})
+		resolved = append(resolved, sr.g.capturePath)
 	}
-	sr.log.Print("Shutdown signal received. Ending server mode.")
-	return nil
+	sr.log.Printf("Resolved sources: %q", resolved)
 }
 
-func statSources(sr *ServerResources) {
+// Scans the valid [ServerResources.rawSources] for log files.
+//
+// Only the initial scan is verbose, re-scans would otherwise
+// repeat the same messages on every pass.
+func statSources(sr *ServerResources, verbose bool) (sources []ValidSourceDescriptor) {
+	l := sr.log
+	if !verbose {
+		l = log.New(io.Discard, "", 0)
+	}
 	for _, src := range sr.rawSources {
 		if !src.valid {
 			continue
 		}
 		i, err := os.Stat(src.absPath)
 		if err != nil {
-			sr.log.Printf("failed stat %q: %+v", src.absPath, err)
+			l.Printf("failed stat %q: %+v", src.absPath, err)
 			continue
 		}
 		if !strings.HasSuffix(i.Name(), ".log") && !i.IsDir() {
-			sr.log.Printf("Warning: not a log file or directory %q", src.absPath)
+			l.Printf("Warning: not a log file or directory %q", src.absPath)
 			continue
 		}
 		var vsd ValidSourceDescriptor
 		vsd.info = i
 		vsd.path = src.absPath
 		if !vsd.info.IsDir() {
+			if vsd.chunks, err = findChunks(vsd.path); err != nil {
+				l.Printf("failed to list chunks of %q: %+v", vsd.path, err)
+			}
+			sources = append(sources, vsd)
+			l.Printf("Confirmed source: %q", vsd.path)
 			continue
 		}
 		vsd.sub = new([]ValidSourceDescriptor)
-		sr.log.Printf("Walking %q", vsd.path)
+		l.Printf("Walking %q", vsd.path)
 		filepath.WalkDir(vsd.path, func(path string, d os.DirEntry, err error) error {
 			if err != nil {
-				sr.log.Printf("Found problematic path %q: %+v", path, err)
-				sr.log.Printf("Aborting walk of %q", vsd.path)
+				l.Printf("Found problematic path %q: %+v", path, err)
+				l.Printf("Aborting walk of %q", vsd.path)
 				return err
 			}
-			if strings.HasSuffix(path, ".log") {
+			if strings.HasSuffix(path, ".log") || isCompressedChunk(path) {
 				f, err := os.Stat(path)
 				if err != nil {
-					sr.log.Print(err)
+					l.Print(err)
 					return nil
 				}
 				sub := ValidSourceDescriptor{
@@ -433,17 +744,93 @@ func statSources(sr *ServerResources) {
 					info: f,
 				}
 				*vsd.sub = append(*vsd.sub, sub)
-				sr.log.Printf("Found sub-source: %q", sub.path)
+				l.Printf("Found sub-source: %q", sub.path)
 			}
 			return nil
 		})
-		sr.validSources = append(sr.validSources, vsd)
-		sr.log.Printf("Confirmed source: %q", vsd.path)
+		*vsd.sub = groupRollingSets(*vsd.sub)
+		sources = append(sources, vsd)
+		l.Printf("Confirmed source: %q", vsd.path)
+	}
+	return sources
+}
+
+// Re-scans the sources and, if the set of viewable files changed,
+// rebuilds the endpoints and the cached home page.
+// Verbose refreshes always rebuild them, since they follow
+// changes to the source paths themselves.
+//
+// Must not run concurrently with itself.
+func refreshSources(sr *ServerResources, verbose bool) {
+	sources := statSources(sr, verbose)
+	old := sr.endpoints.Load()
+	endpoints := buildEndpoints(sources)
+	if old != nil && !verbose && sameEndpoints(*old, endpoints) {
+		return
+	}
+	if old != nil {
+		for path := range endpoints {
+			if _, ok := (*old)[path]; !ok {
+				sr.log.Printf("Source added: %q", endpoints[path].vsd.path)
+			}
+		}
+		for path := range *old {
+			if _, ok := endpoints[path]; !ok {
+				sr.log.Printf("Source removed: %q", (*old)[path].vsd.path)
+			}
+		}
+	}
+	sr.validSources = sources
+	buildHome(sr)
+	sr.endpoints.Store(&endpoints)
+}
+
+// Periodically calls [refreshSources] until the process exits,
+// and reloads the configuration when requested through [ServerResources.reload].
+func watchSources(sr *ServerResources) {
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	// Started below, once the interval is known to be positive.
+	t.Stop()
+	interval, applied := 0, false
+	for {
+		if next := sr.config().rescanInterval; !applied || next != interval {
+			interval, applied = next, true
+			if interval <= 0 {
+				sr.log.Print("Source re-scanning disabled.")
+				t.Stop()
+			} else {
+				t.Reset(time.Duration(interval) * time.Millisecond)
+			}
+		}
+		select {
+		case <-t.C:
+			refreshSources(sr, false)
+		case <-sr.rescan:
+			sr.rescanRequested()
+		case <-sr.reload:
+			if err := reloadConfig(sr); err != nil {
+				sr.log.Printf("Reload failed, keeping the current configuration: %+v", err)
+			}
+		}
 	}
 }
 
-func buildServer(sr *ServerResources, addr string) (shutdown chan any) {
-	shutdown = make(chan any)
+// Whether a and b list the same files, with the same amount of chunks.
+func sameEndpoints(a, b map[string]*SourceEndpoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, ep := range a {
+		other, ok := b[path]
+		if !ok || len(other.vsd.chunks) != len(ep.vsd.chunks) {
+			return false
+		}
+	}
+	return true
+}
+
+func buildServer(sr *ServerResources, addr string) {
 	sr.mux = http.DefaultServeMux
 	sr.s = &http.Server{
 		Addr:    addr,
@@ -457,132 +844,89 @@ func buildServer(sr *ServerResources, addr string) (shutdown chan any) {
 	sr.mux.HandleFunc("/$", func(w http.ResponseWriter, r *http.Request) {
 		sr.log.Print("[/$]")
 		http.Redirect(w, r, "/", http.StatusFound)
-		go func() {
-			sr.log.Print("Shutting down...")
-			sr.s.Shutdown(context.Background())
-			shutdown <- struct{}{}
-		}()
+		sr.g.requestShutdown(0)
 	})
 
-	for _, vsd := range sr.validSources {
-		if vsd.info.IsDir() {
-			for _, sub := range *vsd.sub {
-				if sub.info.IsDir() {
-					continue
-				}
-				buildSourceEndpoints(sr, &sub)
-			}
-		} else {
-			buildSourceEndpoints(sr, &vsd)
-		}
-	}
-
-	return shutdown
-}
-
-func buildSourceEndpoints(sr *ServerResources, vsd *ValidSourceDescriptor) {
-	path, _ := strings.CutPrefix(vsd.path, "/")
-	path = "/src/" + strings.ReplaceAll(path, "\\", "/")
-	document := []byte(strings.Replace(viewerHTML, "<!--PATH-->", vsd.path, 1))
-	sr.log.Printf("Endpoint %s", path)
-	sr.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-		sr.log.Printf("[%s]", path)
-		w.Write(document)
-	})
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:    0,
 		WriteBufferSize:   2048,
 		WriteBufferPool:   &sync.Pool{},
 		EnableCompression: true,
 	}
-	wspath := path + "/$"
-	sr.mux.HandleFunc(wspath, func(w http.ResponseWriter, r *http.Request) {
-		tag := fmt.Sprintf("[%s]", wspath)
-		sr.log.Print(tag)
+	sr.mux.HandleFunc("/src/", func(w http.ResponseWriter, r *http.Request) {
+		path, stream := strings.CutSuffix(r.URL.Path, "/$")
+		ep, ok := (*sr.endpoints.Load())[path]
+		if !ok {
+			sr.log.Printf("[%s] Unknown source", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		if !stream {
+			sr.log.Printf("[%s]", path)
+			w.Write(ep.document)
+			return
+		}
+		tag := fmt.Sprintf("[%s]", r.URL.Path)
+		sr.log.Printf("%s %s", tag, r.URL.RawQuery)
+		opts, err := parseStreamOptions(r.URL.Query())
+		if err != nil {
+			sr.log.Printf("%s Bad request: %+v", tag, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		c, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			sr.log.Printf("%s Upgrade error: %+v", tag, err)
+			return
 		}
-		go logReads(tag, sr, c)
-		streamLogFile(tag, sr, vsd, c)
+		streamLogFile(tag, sr, ep.vsd, c, opts)
+	})
+	sr.mux.HandleFunc("/ingest/", func(w http.ResponseWriter, r *http.Request) {
+		handlePush(sr, w, r)
+	})
+	sr.mux.HandleFunc(OTLP_LOGS_PATH, func(w http.ResponseWriter, r *http.Request) {
+		handleOtlpLogs(sr, w, r)
 	})
 }
 
-type WriterFunc func([]byte) (int, error)
-
-func (f WriterFunc) Write(p []byte) (int, error) { return f(p) }
-
-func streamLogFile(tag string, sr *ServerResources, vsd *ValidSourceDescriptor, conn *websocket.Conn) {
-	f, err := os.Open(vsd.path)
-	if err != nil {
-		sr.log.Printf("%s File error: %+v", tag, err)
-		conn.Close()
-		return
-	}
-	r := bufio.NewReaderSize(f, READ_BUFFER_SIZE)
-	var partial []byte
-	var eof bool
-	t := time.NewTimer(0)
-	var lastKnownSize int64
-	for {
-		info, err := os.Stat(vsd.path)
-		if err != nil {
-			sr.log.Printf("%s Stat error: %+v", tag, err)
-			conn.Close()
-			return
-		}
-		if info.Size() > lastKnownSize {
-			lastKnownSize = info.Size()
-			eof = false
-		}
-		for !eof {
-			line, err := r.ReadBytes('\n')
-			if err == io.EOF {
-				if len(line) != 0 {
-					if partial != nil {
-						partial = bytes.Join([][]byte{partial, line}, nil)
-					} else {
-						partial = line
-					}
-				}
-				eof = true
-				break
-			}
-			if err != nil {
-				sr.log.Printf("%s Reader error: %+v", tag, err)
-				last := bytes.Join([][]byte{partial, line}, nil)
-				if len(last) != 0 {
-					err = conn.WriteMessage(websocket.TextMessage, []byte(last))
-					if err != nil {
-						sr.log.Printf("%s Write error: %+v", tag, err)
-					}
+// Maps every viewable file in sources to its endpoint.
+func buildEndpoints(sources []ValidSourceDescriptor) map[string]*SourceEndpoint {
+	endpoints := make(map[string]*SourceEndpoint)
+	for _, vsd := range sources {
+		if vsd.info.IsDir() {
+			for _, sub := range *vsd.sub {
+				if sub.info.IsDir() {
+					continue
 				}
-				conn.Close()
-				return
+				ep := newSourceEndpoint(&sub)
+				endpoints[ep.path] = ep
 			}
-			if partial != nil {
-				line = bytes.Join([][]byte{partial, line}, nil)
-				partial = nil
-			}
-			conn.WriteMessage(websocket.TextMessage, line)
+		} else {
+			ep := newSourceEndpoint(&vsd)
+			endpoints[ep.path] = ep
 		}
-		t.Reset(time.Duration(sr.g.pollingInterval))
-		<-t.C
 	}
-
+	return endpoints
 }
 
-func logReads(tag string, sr *ServerResources, conn *websocket.Conn) {
-	for {
-		if t, b, err := conn.ReadMessage(); err != nil {
-			sr.log.Printf("%s Read error: %+v", tag, err)
-			break
-		} else {
-			sr.log.Printf("%s Unexpected read (type %d): %q", tag, t, string(b))
-		}
+func newSourceEndpoint(vsd *ValidSourceDescriptor) *SourceEndpoint {
+	return &SourceEndpoint{
+		path:     endpointPath(vsd.path),
+		vsd:      vsd,
+		document: []byte(strings.Replace(viewerHTML, "<!--PATH-->", vsd.path, 1)),
 	}
 }
 
+// Returns the "/src/..." endpoint path of the file at p.
+func endpointPath(p string) string {
+	path, _ := strings.CutPrefix(p, "/")
+	return "/src/" + strings.ReplaceAll(path, "\\", "/")
+}
+
+type WriterFunc func([]byte) (int, error)
+
+func (f WriterFunc) Write(p []byte) (int, error) { return f(p) }
+
 const sourceGroupHTML string = "<li><h3>%s</h3><ul>%s</ul></li>"
 const sourceLinkHTML string = "<li><a href=\"/src/%s\">%s</a></li>"
 
@@ -602,17 +946,24 @@ func buildHome(sr *ServerResources) {
 					sr.log.Printf("Relative sub-source path error: %+v", err)
 					continue
 				}
-				group.Write(fmt.Appendf(nil, sourceLinkHTML, sub.path, rel))
+				group.Write(fmt.Appendf(nil, sourceLinkHTML, sub.path, rel+chunksLabel(&sub)))
 			}
 			sb.Write(fmt.Appendf(nil, sourceGroupHTML, vsd.path, group.String()))
 		} else {
-			sb.Write(fmt.Appendf(nil, sourceLinkHTML, vsd.path, vsd.path))
+			sb.Write(fmt.Appendf(nil, sourceLinkHTML, vsd.path, vsd.path+chunksLabel(&vsd)))
 		}
 	}
 	resp := []byte(strings.Replace(indexHTML, "<!--SOURCES-->", sb.String(), 1))
 	sr.cachedHome.Store(&resp)
 }
 
+func chunksLabel(vsd *ValidSourceDescriptor) string {
+	if len(vsd.chunks) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (+%d rotated)", len(vsd.chunks))
+}
+
 func getLogger(p string) *log.Logger {
 	var l log.Logger
 	l.SetFlags(LOGGER_FLAGS)
@@ -27,9 +27,9 @@ func Demo() {
 		log.Fatalf("Build demo binary %q: %q", bin, err)
 	}
 
-	source := exec.Command(bin, "-d", "-l")
-	capture := exec.Command(bin, "-c")
-	server := exec.Command(bin)
+	source := exec.Command(bin, "demo", "-l")
+	capture := exec.Command(bin, "capture")
+	server := exec.Command(bin, "serve")
 
 	cin, err := capture.StdinPipe()
 	if err != nil {
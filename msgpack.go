@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Max size of a single msgpack string or binary.
+const MAX_MSGPACK_VALUE_SIZE int = 32 << 20
+
+// Max nesting of msgpack arrays and maps.
+const MAX_MSGPACK_DEPTH int = 32
+
+var errMsgpackTooDeep = errors.New("values nested too deeply")
+
+var errMsgpackTooLarge = errors.New("value larger than the size limit")
+
+// A msgpack extension value, such as a Fluent EventTime.
+type MsgpackExt struct {
+	typ  int8
+	data []byte
+}
+
+// Decodes msgpack values, see https://github.com/msgpack/msgpack/blob/master/spec.md.
+//
+// Values are decoded into nil, bool, int64, uint64 (only above [math.MaxInt64]),
+// float64, string, []byte, []any, []KeyValue and [MsgpackExt]. Map keys
+// other than strings are formatted as such.
+type MsgpackReader struct {
+	r *bufio.Reader
+	// Max bytes read by each call to [MsgpackReader.decode], unlimited if zero.
+	limit int
+	// Bytes left of limit for the value being decoded.
+	left int
+}
+
+func newMsgpackReader(r io.Reader) *MsgpackReader {
+	if br, ok := r.(*bufio.Reader); ok {
+		return &MsgpackReader{r: br}
+	}
+	return &MsgpackReader{r: bufio.NewReader(r)}
+}
+
+// Decodes the next value. Returns [io.EOF] only if there are no more values,
+// and [io.ErrUnexpectedEOF] if one was cut short.
+func (d *MsgpackReader) decode() (any, error) {
+	d.left = d.limit
+	return d.value(0)
+}
+
+// Counts n bytes about to be read against the limit.
+func (d *MsgpackReader) consume(n int) error {
+	if d.limit == 0 {
+		return nil
+	}
+	if n > d.left {
+		return fmt.Errorf("%w of %d bytes", errMsgpackTooLarge, d.limit)
+	}
+	d.left -= n
+	return nil
+}
+
+func (d *MsgpackReader) value(depth int) (any, error) {
+	if depth > MAX_MSGPACK_DEPTH {
+		return nil, errMsgpackTooDeep
+	}
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if err := d.consume(1); err != nil {
+		return nil, err
+	}
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c >= 0x80 && c <= 0x8f:
+		return d.mapOf(int(c&0x0f), depth)
+	case c >= 0x90 && c <= 0x9f:
+		return d.arrayOf(int(c&0x0f), depth)
+	case c >= 0xa0 && c <= 0xbf:
+		b, err := d.bytes(int(c & 0x1f))
+		return string(b), err
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.length(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.bytes(n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.length(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.ext(n)
+	case 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (c - 0xcc))
+		if n > math.MaxInt64 {
+			return n, err
+		}
+		return int64(n), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		n, err := d.uint(size)
+		// Sign-extends the value from its size.
+		shift := 64 - 8*size
+		return int64(n<<shift) >> shift, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(1 << (c - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.length(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.bytes(n)
+		return string(b), err
+	case 0xdc, 0xdd:
+		n, err := d.length(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayOf(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.length(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapOf(n, depth)
+	}
+	return nil, fmt.Errorf("invalid msgpack type 0x%02x", c)
+}
+
+// Reads a big-endian unsigned integer of size bytes.
+func (d *MsgpackReader) uint(size int) (uint64, error) {
+	if err := d.consume(size); err != nil {
+		return 0, err
+	}
+	var buf [8]byte
+	if _, err := io.ReadFull(d.r, buf[8-size:]); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+func (d *MsgpackReader) length(size int) (int, error) {
+	n, err := d.uint(size)
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(MAX_MSGPACK_VALUE_SIZE) {
+		return 0, fmt.Errorf("value too large: %d bytes", n)
+	}
+	return int(n), nil
+}
+
+// Reads n bytes, growing the buffer as they arrive rather than trusting n upfront.
+func (d *MsgpackReader) bytes(n int) ([]byte, error) {
+	if n > MAX_MSGPACK_VALUE_SIZE {
+		return nil, fmt.Errorf("value too large: %d bytes", n)
+	}
+	if err := d.consume(n); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, d.r, int64(n)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *MsgpackReader) ext(n int) (any, error) {
+	typ, err := d.r.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if err := d.consume(1); err != nil {
+		return nil, err
+	}
+	data, err := d.bytes(n)
+	return MsgpackExt{typ: int8(typ), data: data}, err
+}
+
+func (d *MsgpackReader) arrayOf(n int, depth int) ([]any, error) {
+	// Every value takes at least a byte, the length alone can't be trusted.
+	list := make([]any, 0, min(n, 1024))
+	for range n {
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+func (d *MsgpackReader) mapOf(n int, depth int) ([]KeyValue, error) {
+	kvs := make([]KeyValue, 0, min(n, 1024))
+	for range n {
+		k, err := d.value(depth + 1)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		key, ok := k.(string)
+		if !ok {
+			key = string(appendStructuredValue(nil, k))
+		}
+		kvs = append(kvs, KeyValue{key, v})
+	}
+	return kvs, nil
+}
+
+// Values cut short end with [io.ErrUnexpectedEOF] rather than [io.EOF].
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Appends s as a msgpack string.
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xda)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, 0xdb)
+		b = binary.BigEndian.AppendUint32(b, uint32(n))
+	}
+	return append(b, s...)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMsgpackReader(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want any
+		err  error
+	}{
+		{"positive fixint", "\x05", int64(5), nil},
+		{"negative fixint", "\xff", int64(-1), nil},
+		{"nil", "\xc0", nil, nil},
+		{"false", "\xc2", false, nil},
+		{"true", "\xc3", true, nil},
+		{"uint8", "\xcc\xff", int64(255), nil},
+		{"uint16", "\xcd\x01\x00", int64(256), nil},
+		{"uint64 above int64", "\xcf\xff\xff\xff\xff\xff\xff\xff\xff", uint64(math.MaxUint64), nil},
+		{"int8", "\xd0\x80", int64(-128), nil},
+		{"int16", "\xd1\xff\x00", int64(-256), nil},
+		{"int32", "\xd2\xff\xff\xff\xfe", int64(-2), nil},
+		{"int64", "\xd3\x80\x00\x00\x00\x00\x00\x00\x00", int64(math.MinInt64), nil},
+		{"float32", "\xca\x3f\xc0\x00\x00", 1.5, nil},
+		{"float64", "\xcb\x40\x04\x00\x00\x00\x00\x00\x00", 2.5, nil},
+		{"fixstr", "\xa3abc", "abc", nil},
+		{"str8", "\xd9\x03abc", "abc", nil},
+		{"str16", "\xda\x00\x01a", "a", nil},
+		{"bin8", "\xc4\x02\x01\x02", []byte{1, 2}, nil},
+		{"fixarray", "\x92\x01\xa1a", []any{int64(1), "a"}, nil},
+		{"array16", "\xdc\x00\x01\xc0", []any{nil}, nil},
+		{"fixmap", "\x81\xa1a\x01", []KeyValue{{"a", int64(1)}}, nil},
+		{"map16 with a non-string key", "\xde\x00\x01\x01\xa1x", []KeyValue{{"1", "x"}}, nil},
+		{"fixext8", "\xd7\x00\x00\x00\x00\x01\x00\x00\x00\x02", MsgpackExt{0, []byte{0, 0, 0, 1, 0, 0, 0, 2}}, nil},
+		{"ext8", "\xc7\x01\x05\x09", MsgpackExt{5, []byte{9}}, nil},
+		{"empty", "", nil, io.EOF},
+		{"truncated string", "\xa3a", nil, io.ErrUnexpectedEOF},
+		{"truncated integer", "\xcd\x01", nil, io.ErrUnexpectedEOF},
+		{"truncated array", "\x92\x01", nil, io.ErrUnexpectedEOF},
+		{"truncated map", "\x81\xa1a", nil, io.ErrUnexpectedEOF},
+		{"truncated ext", "\xd4", nil, io.ErrUnexpectedEOF},
+		{"too deep", strings.Repeat("\x91", MAX_MSGPACK_DEPTH+1) + "\x01", nil, errMsgpackTooDeep},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newMsgpackReader(strings.NewReader(tt.in)).decode()
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMsgpackReaderInvalid(t *testing.T) {
+	for _, in := range []string{
+		// Never used.
+		"\xc1",
+		// Lengths above MAX_MSGPACK_VALUE_SIZE.
+		"\xdb\xff\xff\xff\xff",
+		"\xc6\xff\xff\xff\xff",
+		"\xc9\xff\xff\xff\xff\x00",
+	} {
+		if v, err := newMsgpackReader(strings.NewReader(in)).decode(); err == nil {
+			t.Errorf("decode(%q) = %#v, want an error", in, v)
+		}
+	}
+}
+
+func TestMsgpackReaderStream(t *testing.T) {
+	d := newMsgpackReader(strings.NewReader("\x01\xa1a\xc3"))
+	for _, want := range []any{int64(1), "a", true} {
+		got, err := d.decode()
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %#v, %v, want %#v", got, err, want)
+		}
+	}
+	if _, err := d.decode(); err != io.EOF {
+		t.Errorf("error %v at the end, want EOF", err)
+	}
+}
+
+func TestMsgpackReaderLimit(t *testing.T) {
+	// A 3 bytes array, twice, then a 6 bytes string.
+	d := newMsgpackReader(strings.NewReader("\x92\x01\x02\x92\x03\x04\xa5hello"))
+	d.limit = 4
+	for _, want := range []any{[]any{int64(1), int64(2)}, []any{int64(3), int64(4)}} {
+		got, err := d.decode()
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %#v, %v, want %#v", got, err, want)
+		}
+	}
+	if v, err := d.decode(); !errors.Is(err, errMsgpackTooLarge) {
+		t.Errorf("got %#v, %v, want %v", v, err, errMsgpackTooLarge)
+	}
+	// Lengths are checked before reading.
+	d = newMsgpackReader(strings.NewReader("\xc6\x00\x10\x00\x00"))
+	d.limit = 1 << 10
+	if v, err := d.decode(); !errors.Is(err, errMsgpackTooLarge) {
+		t.Errorf("got %#v, %v, want %v", v, err, errMsgpackTooLarge)
+	}
+}
+
+func TestAppendMsgpackString(t *testing.T) {
+	for _, n := range []int{0, 31, 32, 255, 256, math.MaxUint16, math.MaxUint16 + 1} {
+		s := strings.Repeat("x", n)
+		b := appendMsgpackString(nil, s)
+		got, err := newMsgpackReader(bytes.NewReader(b)).decode()
+		if got, _ := got.(string); err != nil || got != s {
+			t.Errorf("length %d: decoded %d bytes, %v", n, len(got), err)
+		}
+	}
+}
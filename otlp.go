@@ -0,0 +1,605 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Path OTLP/HTTP exporters send logs to, see [handleOtlpLogs].
+const OTLP_LOGS_PATH string = "/v1/logs"
+
+// Max size of an OTLP request, once decompressed.
+const MAX_OTLP_REQUEST_SIZE int64 = 32 << 20
+
+// Max nesting of attribute values, which would otherwise only be bounded by the request size.
+const MAX_OTLP_VALUE_DEPTH int = 32
+
+// Capture id of resources without a "service.name" attribute,
+// the name the OpenTelemetry SDKs default to.
+const OTLP_UNKNOWN_SERVICE string = "unknown_service"
+
+var errOtlpTooDeep = errors.New("attribute values nested too deeply")
+
+// Short names of the severity numbers, from 1 up to 24.
+var otlpSeverities = []string{
+	"TRACE", "TRACE2", "TRACE3", "TRACE4", "DEBUG", "DEBUG2", "DEBUG3", "DEBUG4",
+	"INFO", "INFO2", "INFO3", "INFO4", "WARN", "WARN2", "WARN3", "WARN4",
+	"ERROR", "ERROR2", "ERROR3", "ERROR4", "FATAL", "FATAL2", "FATAL3", "FATAL4",
+}
+
+// The log records of a single resource.
+type OtlpResourceLogs struct {
+	service string
+	records []OtlpRecord
+}
+
+// A LogRecord, with the fields Logyard keeps.
+type OtlpRecord struct {
+	// The time of the event, or when it was observed, or received.
+	time           time.Time
+	severityNumber int
+	severityText   string
+	// Hex-encoded, empty if unset.
+	traceId string
+	spanId  string
+	// A [KeyValue] value.
+	body       any
+	attributes []KeyValue
+}
+
+// Decodes an ExportLogsServiceRequest in the binary Protocol Buffers encoding.
+func decodeOtlpProto(b []byte) ([]OtlpResourceLogs, error) {
+	var logs []OtlpResourceLogs
+	r := &ProtoReader{b}
+	for !r.done() {
+		field, wire, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if field != 1 || wire != WIRE_BYTES {
+			if err := r.skip(wire); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		m, err := r.message()
+		if err != nil {
+			return nil, err
+		}
+		rl, err := decodeOtlpResourceLogs(m)
+		if err != nil {
+			return nil, fmt.Errorf("resource logs %d: %w", len(logs), err)
+		}
+		logs = append(logs, rl)
+	}
+	return logs, nil
+}
+
+func decodeOtlpResourceLogs(r *ProtoReader) (rl OtlpResourceLogs, err error) {
+	for !r.done() {
+		field, wire, err := r.next()
+		if err != nil {
+			return rl, err
+		}
+		var m *ProtoReader
+		switch {
+		case field == 1 && wire == WIRE_BYTES:
+			// Resource.
+			if m, err = r.message(); err == nil {
+				rl.service, err = decodeOtlpResource(m)
+			}
+		case field == 2 && wire == WIRE_BYTES:
+			// ScopeLogs.
+			if m, err = r.message(); err == nil {
+				err = decodeOtlpScopeLogs(m, &rl.records)
+			}
+		default:
+			err = r.skip(wire)
+		}
+		if err != nil {
+			return rl, err
+		}
+	}
+	return rl, nil
+}
+
+// Returns the "service.name" attribute of a Resource.
+func decodeOtlpResource(r *ProtoReader) (service string, err error) {
+	for !r.done() {
+		field, wire, err := r.next()
+		if err != nil {
+			return "", err
+		}
+		if field != 1 || wire != WIRE_BYTES {
+			if err := r.skip(wire); err != nil {
+				return "", err
+			}
+			continue
+		}
+		m, err := r.message()
+		if err != nil {
+			return "", err
+		}
+		kv, err := decodeOtlpKeyValue(m, 0)
+		if err != nil {
+			return "", err
+		}
+		if v, ok := kv.value.(string); ok && kv.key == "service.name" {
+			service = v
+		}
+	}
+	return service, nil
+}
+
+func decodeOtlpScopeLogs(r *ProtoReader, records *[]OtlpRecord) error {
+	for !r.done() {
+		field, wire, err := r.next()
+		if err != nil {
+			return err
+		}
+		if field != 2 || wire != WIRE_BYTES {
+			if err := r.skip(wire); err != nil {
+				return err
+			}
+			continue
+		}
+		m, err := r.message()
+		if err != nil {
+			return err
+		}
+		rec, err := decodeOtlpLogRecord(m)
+		if err != nil {
+			return fmt.Errorf("log record %d: %w", len(*records), err)
+		}
+		*records = append(*records, rec)
+	}
+	return nil
+}
+
+func decodeOtlpLogRecord(r *ProtoReader) (rec OtlpRecord, err error) {
+	var t, observed uint64
+	for !r.done() {
+		field, wire, err := r.next()
+		if err != nil {
+			return rec, err
+		}
+		var v uint64
+		var b []byte
+		var m *ProtoReader
+		switch {
+		case field == 1 && wire == WIRE_FIXED64:
+			t, err = r.fixed64()
+		case field == 11 && wire == WIRE_FIXED64:
+			observed, err = r.fixed64()
+		case field == 2 && wire == WIRE_VARINT:
+			v, err = r.varint()
+			rec.severityNumber = int(v)
+		case field == 3 && wire == WIRE_BYTES:
+			b, err = r.bytes()
+			rec.severityText = string(b)
+		case field == 5 && wire == WIRE_BYTES:
+			if m, err = r.message(); err == nil {
+				rec.body, err = decodeOtlpAnyValue(m, 0)
+			}
+		case field == 6 && wire == WIRE_BYTES:
+			if m, err = r.message(); err == nil {
+				var kv KeyValue
+				kv, err = decodeOtlpKeyValue(m, 0)
+				rec.attributes = append(rec.attributes, kv)
+			}
+		case field == 9 && wire == WIRE_BYTES:
+			b, err = r.bytes()
+			rec.traceId = otlpId(b)
+		case field == 10 && wire == WIRE_BYTES:
+			b, err = r.bytes()
+			rec.spanId = otlpId(b)
+		default:
+			err = r.skip(wire)
+		}
+		if err != nil {
+			return rec, err
+		}
+	}
+	rec.time = otlpTime(int64(t), int64(observed))
+	return rec, nil
+}
+
+func decodeOtlpKeyValue(r *ProtoReader, depth int) (kv KeyValue, err error) {
+	for !r.done() {
+		field, wire, err := r.next()
+		if err != nil {
+			return kv, err
+		}
+		var b []byte
+		var m *ProtoReader
+		switch {
+		case field == 1 && wire == WIRE_BYTES:
+			b, err = r.bytes()
+			kv.key = string(b)
+		case field == 2 && wire == WIRE_BYTES:
+			if m, err = r.message(); err == nil {
+				kv.value, err = decodeOtlpAnyValue(m, depth)
+			}
+		default:
+			err = r.skip(wire)
+		}
+		if err != nil {
+			return kv, err
+		}
+	}
+	return kv, nil
+}
+
+func decodeOtlpAnyValue(r *ProtoReader, depth int) (v any, err error) {
+	if depth > MAX_OTLP_VALUE_DEPTH {
+		return nil, errOtlpTooDeep
+	}
+	for !r.done() {
+		field, wire, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		var n uint64
+		var b []byte
+		var m *ProtoReader
+		switch {
+		case field == 1 && wire == WIRE_BYTES:
+			b, err = r.bytes()
+			v = string(b)
+		case field == 2 && wire == WIRE_VARINT:
+			n, err = r.varint()
+			v = n != 0
+		case field == 3 && wire == WIRE_VARINT:
+			n, err = r.varint()
+			v = int64(n)
+		case field == 4 && wire == WIRE_FIXED64:
+			n, err = r.fixed64()
+			v = math.Float64frombits(n)
+		case field == 5 && wire == WIRE_BYTES:
+			// ArrayValue, holding AnyValues.
+			if m, err = r.message(); err == nil {
+				v, err = decodeOtlpList(m, func(m *ProtoReader) (any, error) {
+					return decodeOtlpAnyValue(m, depth+1)
+				})
+			}
+		case field == 6 && wire == WIRE_BYTES:
+			// KeyValueList, holding KeyValues.
+			if m, err = r.message(); err == nil {
+				var list []any
+				list, err = decodeOtlpList(m, func(m *ProtoReader) (any, error) {
+					return decodeOtlpKeyValue(m, depth+1)
+				})
+				kvs := make([]KeyValue, len(list))
+				for i := range list {
+					kvs[i] = list[i].(KeyValue)
+				}
+				v = kvs
+			}
+		case field == 7 && wire == WIRE_BYTES:
+			b, err = r.bytes()
+			v = b
+		default:
+			err = r.skip(wire)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// Decodes the repeated messages of field 1, as in ArrayValue and KeyValueList.
+func decodeOtlpList(r *ProtoReader, decode func(m *ProtoReader) (any, error)) ([]any, error) {
+	var list []any
+	for !r.done() {
+		field, wire, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if field != 1 || wire != WIRE_BYTES {
+			if err := r.skip(wire); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		m, err := r.message()
+		if err != nil {
+			return nil, err
+		}
+		v, err := decode(m)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+// Hex-encodes a trace or span id, empty if unset or invalid, that is, all zeros.
+func otlpId(b []byte) string {
+	for _, c := range b {
+		if c != 0 {
+			return hex.EncodeToString(b)
+		}
+	}
+	return ""
+}
+
+// Returns the time of a record, falling back to when it was observed,
+// then to now, since both are optional.
+func otlpTime(t int64, observed int64) time.Time {
+	if t == 0 {
+		t = observed
+	}
+	if t == 0 {
+		return time.Now()
+	}
+	return time.Unix(0, t)
+}
+
+// The OTLP/JSON encoding of ExportLogsServiceRequest. Field names are in lower
+// camel case, 64-bit integers may be strings, and ids are hex-encoded.
+type otlpJSONRequest struct {
+	ResourceLogs []struct {
+		Resource struct {
+			Attributes []otlpJSONKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []struct {
+			LogRecords []otlpJSONRecord `json:"logRecords"`
+		} `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+type otlpJSONRecord struct {
+	TimeUnixNano         otlpJSONInt        `json:"timeUnixNano"`
+	ObservedTimeUnixNano otlpJSONInt        `json:"observedTimeUnixNano"`
+	SeverityNumber       int                `json:"severityNumber"`
+	SeverityText         string             `json:"severityText"`
+	Body                 *otlpJSONValue     `json:"body"`
+	Attributes           []otlpJSONKeyValue `json:"attributes"`
+	TraceId              string             `json:"traceId"`
+	SpanId               string             `json:"spanId"`
+}
+
+type otlpJSONKeyValue struct {
+	Key   string         `json:"key"`
+	Value *otlpJSONValue `json:"value"`
+}
+
+type otlpJSONValue struct {
+	StringValue *string      `json:"stringValue"`
+	BoolValue   *bool        `json:"boolValue"`
+	IntValue    *otlpJSONInt `json:"intValue"`
+	DoubleValue *float64     `json:"doubleValue"`
+	ArrayValue  *struct {
+		Values []*otlpJSONValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []otlpJSONKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+	BytesValue []byte `json:"bytesValue"`
+}
+
+// A 64-bit integer, encoded either as a JSON number or a string.
+type otlpJSONInt int64
+
+func (i *otlpJSONInt) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	*i = otlpJSONInt(v)
+	return err
+}
+
+// Decodes an ExportLogsServiceRequest in the OTLP/JSON encoding.
+func decodeOtlpJSON(b []byte) ([]OtlpResourceLogs, error) {
+	var req otlpJSONRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, err
+	}
+	logs := make([]OtlpResourceLogs, 0, len(req.ResourceLogs))
+	for _, jrl := range req.ResourceLogs {
+		var rl OtlpResourceLogs
+		for _, kv := range jrl.Resource.Attributes {
+			if kv.Key == "service.name" && kv.Value != nil && kv.Value.StringValue != nil {
+				rl.service = *kv.Value.StringValue
+			}
+		}
+		for _, sl := range jrl.ScopeLogs {
+			for _, jr := range sl.LogRecords {
+				rec := OtlpRecord{
+					time:           otlpTime(int64(jr.TimeUnixNano), int64(jr.ObservedTimeUnixNano)),
+					severityNumber: jr.SeverityNumber,
+					severityText:   jr.SeverityText,
+					traceId:        strings.ToLower(jr.TraceId),
+					spanId:         strings.ToLower(jr.SpanId),
+					body:           jr.Body.value(),
+					attributes:     otlpJSONAttributes(jr.Attributes),
+				}
+				if strings.Trim(rec.traceId, "0") == "" {
+					rec.traceId = ""
+				}
+				if strings.Trim(rec.spanId, "0") == "" {
+					rec.spanId = ""
+				}
+				rl.records = append(rl.records, rec)
+			}
+		}
+		logs = append(logs, rl)
+	}
+	return logs, nil
+}
+
+func otlpJSONAttributes(kvs []otlpJSONKeyValue) []KeyValue {
+	attrs := make([]KeyValue, len(kvs))
+	for i, kv := range kvs {
+		attrs[i] = KeyValue{key: kv.Key, value: kv.Value.value()}
+	}
+	return attrs
+}
+
+// Returns the value held by v, as decoded by [decodeOtlpAnyValue].
+// Nesting is bounded by the depth limit of [json.Unmarshal].
+func (v *otlpJSONValue) value() any {
+	switch {
+	case v == nil:
+		return nil
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.ArrayValue != nil:
+		list := make([]any, len(v.ArrayValue.Values))
+		for i, item := range v.ArrayValue.Values {
+			list[i] = item.value()
+		}
+		return list
+	case v.KvlistValue != nil:
+		return otlpJSONAttributes(v.KvlistValue.Values)
+	case v.BytesValue != nil:
+		return v.BytesValue
+	}
+	return nil
+}
+
+// Formats rec as a single line:
+//
+//	<time> <severity> trace_id=<id> span_id=<id> <key>=<value>...: <body>
+//
+// The severity is the short name of its number when set, its text otherwise,
+// or "-". Ids are skipped when unset, values quoted when ambiguous,
+// and nested values written as JSON.
+func (rec *OtlpRecord) appendLine(b []byte) []byte {
+	b = rec.time.UTC().AppendFormat(b, INGEST_TIME_FORMAT)
+	b = append(b, ' ')
+	switch {
+	case rec.severityNumber >= 1 && rec.severityNumber <= len(otlpSeverities):
+		b = append(b, otlpSeverities[rec.severityNumber-1]...)
+	case rec.severityText != "":
+		b = appendFieldValue(b, rec.severityText)
+	default:
+		b = append(b, '-')
+	}
+	if rec.traceId != "" {
+		b = append(b, " trace_id="...)
+		b = append(b, rec.traceId...)
+	}
+	if rec.spanId != "" {
+		b = append(b, " span_id="...)
+		b = append(b, rec.spanId...)
+	}
+	for _, kv := range rec.attributes {
+		b = appendField(b, kv)
+	}
+	b = append(b, ": "...)
+	if s, ok := rec.body.(string); ok {
+		b = appendEscapedLine(b, s)
+	} else if rec.body != nil {
+		b = appendStructuredValue(b, rec.body)
+	}
+	return append(b, '\n')
+}
+
+// Receives an OTLP/HTTP logs export, in either encoding, gzipped or not,
+// appending every record to the capture file of its service.
+func handleOtlpLogs(sr *ServerResources, w http.ResponseWriter, r *http.Request) {
+	tag := fmt.Sprintf("[%s]", r.URL.Path)
+	if !sr.beginPush(tag, w, r) {
+		return
+	}
+	defer sr.pushWg.Done()
+	var decode func([]byte) ([]OtlpResourceLogs, error)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-protobuf":
+		decode = decodeOtlpProto
+	case "application/json":
+		decode = decodeOtlpJSON
+	default:
+		http.Error(w, fmt.Sprintf("unsupported content type %q", mediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+	var body io.Reader = http.MaxBytesReader(w, r.Body, MAX_OTLP_REQUEST_SIZE)
+	switch enc := r.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, "malformed gzip body", http.StatusBadRequest)
+			return
+		}
+		body = gz
+	default:
+		http.Error(w, fmt.Sprintf("unsupported content encoding %q", enc), http.StatusUnsupportedMediaType)
+		return
+	}
+	b, err := io.ReadAll(io.LimitReader(body, MAX_OTLP_REQUEST_SIZE+1))
+	if err == nil && int64(len(b)) > MAX_OTLP_REQUEST_SIZE {
+		err = &http.MaxBytesError{Limit: MAX_OTLP_REQUEST_SIZE}
+	}
+	if mbe := (*http.MaxBytesError)(nil); errors.As(err, &mbe) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		sr.log.Printf("%s Read error: %+v", tag, err)
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	logs, err := decode(b)
+	if err != nil {
+		sr.log.Printf("%s Bad request: %+v", tag, err)
+		http.Error(w, "malformed request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	records := 0
+	var line []byte
+	for _, rl := range logs {
+		if len(rl.records) == 0 {
+			continue
+		}
+		service := rl.service
+		if service == "" {
+			service = OTLP_UNKNOWN_SERVICE
+		}
+		id := sanitizeCaptureId(service)
+		f, err := sr.ingest.get(id)
+		if err != nil {
+			sr.log.Printf("%s Capture error: %+v", tag, err)
+			http.Error(w, "failed to open capture file", http.StatusInternalServerError)
+			return
+		}
+		out := f.writer(&sr.g.CaptureConfig, "")
+		for i := range rl.records {
+			line = rl.records[i].appendLine(line[:0])
+			if _, err := out.Write(line); err != nil {
+				sr.ingest.release(f)
+				sr.log.Printf("%s Capture error after %d records: %+v", tag, records, err)
+				http.Error(w, "failed to write capture file", http.StatusInternalServerError)
+				return
+			}
+			records++
+		}
+		sr.ingest.release(f)
+		sr.requestRescan(endpointPath(capturePathOf(sr.g, id, id)))
+	}
+	sr.log.Printf("%s Captured %d records.", tag, records)
+	// An empty ExportLogsServiceResponse, reporting full success.
+	w.Header().Set("Content-Type", mediaType)
+	if mediaType == "application/json" {
+		w.Write([]byte("{}"))
+	}
+}
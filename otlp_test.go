@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Returns server resources accepting pushed lines into a temporary directory.
+func newPushTestServer(t *testing.T) *ServerResources {
+	t.Helper()
+	g := &Globals{GlobalConfig: &GlobalConfig{}}
+	g.capturePath = t.TempDir()
+	sr := &ServerResources{g: g, log: log.New(io.Discard, "", 0)}
+	cfg := ServerConfig{push: true}
+	sr.cfg.Store(&cfg)
+	sr.rescan = make(chan struct{}, 1)
+	sr.ingest = newCaptureFiles(g)
+	endpoints := map[string]*SourceEndpoint{}
+	sr.endpoints.Store(&endpoints)
+	sr.rawSources = []RawSourceDescriptor{{rawPath: g.capturePath, absPath: g.capturePath, valid: true}}
+	// Serves rescan requests, as watchSources does.
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sr.rescan:
+				sr.rescanRequested()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		sr.ingest.Close()
+	})
+	return sr
+}
+
+// Returns the contents of every capture file written by sr, keyed by name.
+func readCaptures(t *testing.T, sr *ServerResources) map[string]string {
+	t.Helper()
+	return readFiles(t, sr.g.capturePath)
+}
+
+func pbTag(b []byte, field int, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wire))
+}
+
+func pbVarint(b []byte, field int, v uint64) []byte {
+	return binary.AppendUvarint(pbTag(b, field, WIRE_VARINT), v)
+}
+
+func pbFixed64(b []byte, field int, v uint64) []byte {
+	return binary.LittleEndian.AppendUint64(pbTag(b, field, WIRE_FIXED64), v)
+}
+
+func pbBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(pbTag(b, field, WIRE_BYTES), uint64(len(v)))
+	return append(b, v...)
+}
+
+func pbString(b []byte, field int, v string) []byte {
+	return pbBytes(b, field, []byte(v))
+}
+
+// Encodes an AnyValue holding v.
+func pbAnyValue(v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return pbString(nil, 1, v)
+	case bool:
+		var n uint64
+		if v {
+			n = 1
+		}
+		return pbVarint(nil, 2, n)
+	case int:
+		return pbVarint(nil, 3, uint64(v))
+	case float64:
+		return binary.LittleEndian.AppendUint64(pbTag(nil, 4, WIRE_FIXED64), math.Float64bits(v))
+	case []any:
+		var list []byte
+		for _, item := range v {
+			list = pbBytes(list, 1, pbAnyValue(item))
+		}
+		return pbBytes(nil, 5, list)
+	}
+	panic("unsupported value")
+}
+
+func pbKeyValue(key string, v any) []byte {
+	return pbBytes(pbString(nil, 1, key), 2, pbAnyValue(v))
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// An ExportLogsServiceRequest with two resources, one of them without a service name.
+func otlpProtoRequest() []byte {
+	var rec []byte
+	rec = pbFixed64(rec, 1, 1714564800123000000)
+	rec = pbVarint(rec, 2, 17)
+	rec = pbString(rec, 3, "Error")
+	rec = pbBytes(rec, 5, pbAnyValue("payment failed\nretrying"))
+	rec = pbBytes(rec, 6, pbKeyValue("order.id", 42))
+	rec = pbBytes(rec, 6, pbKeyValue("user", "a b"))
+	rec = pbBytes(rec, 6, pbKeyValue("tags", []any{"x", 1.5, true}))
+	rec = pbBytes(rec, 9, mustHex("5b8efff798038103d269b633813fc60c"))
+	rec = pbBytes(rec, 10, mustHex("eee19b7ec3c1b174"))
+	// Unknown fields are skipped.
+	rec = pbString(rec, 99, "unknown")
+	var rec2 []byte
+	rec2 = pbFixed64(rec2, 11, 1714564800000000000)
+	rec2 = pbBytes(rec2, 5, pbAnyValue([]any{-3, "a"}))
+
+	var resource []byte
+	resource = pbBytes(resource, 1, pbKeyValue("service.name", "checkout api"))
+	resource = pbBytes(resource, 1, pbKeyValue("host.name", "h1"))
+	var scope []byte
+	scope = pbBytes(scope, 1, pbString(nil, 1, "scope"))
+	scope = pbBytes(scope, 2, rec)
+	scope = pbBytes(scope, 2, rec2)
+	var req []byte
+	req = pbBytes(req, 1, pbBytes(pbBytes(nil, 1, resource), 2, scope))
+
+	var rec3 []byte
+	rec3 = pbFixed64(rec3, 1, 1714564801000000000)
+	rec3 = pbString(rec3, 3, "info")
+	rec3 = pbBytes(rec3, 5, pbAnyValue("no service"))
+	return pbBytes(req, 1, pbBytes(nil, 2, pbBytes(nil, 2, rec3)))
+}
+
+const otlpJSONRequestBody = `{"resourceLogs":[{
+	"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"jsvc"}}]},
+	"scopeLogs":[{"scope":{"name":"s"},"logRecords":[
+		{"timeUnixNano":"1714564800500000000","severityNumber":9,"severityText":"Information",
+		 "traceId":"5B8EFFF798038103D269B633813FC60C","spanId":"EEE19B7EC3C1B174",
+		 "body":{"stringValue":"hello json"},
+		 "attributes":[{"key":"n","value":{"intValue":"7"}},{"key":"b","value":{"bytesValue":"AQI="}}]},
+		{"timeUnixNano":1714564800600000000,"unknownField":true,
+		 "body":{"kvlistValue":{"values":[{"key":"a","value":{"doubleValue":2.5}}]}}}
+	]}]
+}]}`
+
+var otlpProtoCaptures = map[string]string{
+	"checkout_api.log": "2024-05-01T12:00:00.123Z ERROR trace_id=5b8efff798038103d269b633813fc60c span_id=eee19b7ec3c1b174" +
+		` order.id=42 user="a b" tags=["x",1.5,true]: payment failed\nretrying` + "\n" +
+		`2024-05-01T12:00:00.000Z -: [-3,"a"]` + "\n",
+	OTLP_UNKNOWN_SERVICE + ".log": "2024-05-01T12:00:01.000Z info: no service\n",
+}
+
+var otlpJSONCaptures = map[string]string{
+	"jsvc.log": "2024-05-01T12:00:00.500Z INFO trace_id=5b8efff798038103d269b633813fc60c span_id=eee19b7ec3c1b174 n=7 b=\"AQI=\": hello json\n" +
+		`2024-05-01T12:00:00.600Z -: {"a":2.5}` + "\n",
+}
+
+func gzipped(b []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(b)
+	gz.Close()
+	return buf.Bytes()
+}
+
+func postOtlpLogs(sr *ServerResources, contentType string, encoding string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, OTLP_LOGS_PATH, bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	if encoding != "" {
+		r.Header.Set("Content-Encoding", encoding)
+	}
+	w := httptest.NewRecorder()
+	handleOtlpLogs(sr, w, r)
+	return w
+}
+
+func TestHandleOtlpLogs(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		encoding    string
+		body        []byte
+		want        map[string]string
+	}{
+		{"protobuf", "application/x-protobuf", "", otlpProtoRequest(), otlpProtoCaptures},
+		{"protobuf gzip", "application/x-protobuf", "gzip", gzipped(otlpProtoRequest()), otlpProtoCaptures},
+		{"json", "application/json", "", []byte(otlpJSONRequestBody), otlpJSONCaptures},
+		{"json gzip", "application/json; charset=utf-8", "gzip", gzipped([]byte(otlpJSONRequestBody)), otlpJSONCaptures},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sr := newPushTestServer(t)
+			w := postOtlpLogs(sr, tt.contentType, tt.encoding, tt.body)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			got := readCaptures(t, sr)
+			if len(got) != len(tt.want) {
+				t.Errorf("captured files %v, want %d", keys(got), len(tt.want))
+			}
+			for name, want := range tt.want {
+				if got[name] != want {
+					t.Errorf("%s:\n got %q\nwant %q", name, got[name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleOtlpLogsMalformed(t *testing.T) {
+	valid := otlpProtoRequest()
+	tests := []struct {
+		name        string
+		contentType string
+		encoding    string
+		body        []byte
+		want        int
+	}{
+		{"truncated protobuf", "application/x-protobuf", "", valid[:len(valid)-3], http.StatusBadRequest},
+		{"truncated varint", "application/x-protobuf", "", []byte{0x0a, 0x80}, http.StatusBadRequest},
+		{"length past the end", "application/x-protobuf", "", []byte{0x0a, 0x05, 0x0a}, http.StatusBadRequest},
+		{"unknown field with a group", "application/x-protobuf", "", pbTag(nil, 99, 3), http.StatusBadRequest},
+		{"unknown field truncated", "application/x-protobuf", "", pbTag(nil, 99, WIRE_FIXED64), http.StatusBadRequest},
+		{"nested unknown field truncated", "application/x-protobuf", "", pbBytes(nil, 1, pbTag(nil, 7, WIRE_FIXED32)), http.StatusBadRequest},
+		{"truncated json", "application/json", "", []byte(otlpJSONRequestBody[:40]), http.StatusBadRequest},
+		{"json of the wrong type", "application/json", "", []byte(`{"resourceLogs":{}}`), http.StatusBadRequest},
+		{"truncated gzip", "application/x-protobuf", "gzip", gzipped(valid)[:20], http.StatusBadRequest},
+		{"not gzip", "application/x-protobuf", "gzip", valid, http.StatusBadRequest},
+		{"unsupported content type", "text/plain", "", []byte("hello"), http.StatusUnsupportedMediaType},
+		{"unsupported encoding", "application/json", "br", []byte("{}"), http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sr := newPushTestServer(t)
+			w := postOtlpLogs(sr, tt.contentType, tt.encoding, tt.body)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if got := readCaptures(t, sr); len(got) != 0 {
+				t.Errorf("captured files %v, want none", keys(got))
+			}
+		})
+	}
+}
+
+func keys(m map[string]string) []string {
+	list := make([]string, 0, len(m))
+	for k := range m {
+		list = append(list, k)
+	}
+	return list
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Time zones of capture timestamps, see [CaptureConfig.timestampZone].
+const (
+	TIMESTAMP_UTC   string = "utc"
+	TIMESTAMP_LOCAL string = "local"
+)
+
+// Named timestamp formats accepted by -ts, on top of Go layouts.
+var timestampFormats = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339ms":   "2006-01-02T15:04:05.000Z07:00",
+	"rfc3339nano": time.RFC3339Nano,
+	// Handled by [LinePrefixer.appendPrefix], not valid layouts.
+	"unix":   "unix",
+	"unixms": "unixms",
+}
+
+func validateTimestampFormat(format string) error {
+	if format == "" {
+		return nil
+	}
+	if _, ok := timestampFormats[format]; ok {
+		return nil
+	}
+	// A layout without any reference component would print itself.
+	if (time.Time{}).Format(format) == format {
+		return fmt.Errorf("invalid timestamp format %q: must be a Go time layout or one of "+
+			"\"rfc3339\", \"rfc3339ms\", \"rfc3339nano\", \"unix\" or \"unixms\"", format)
+	}
+	return nil
+}
+
+func validateTimestampZone(zone string) error {
+	switch zone {
+	case TIMESTAMP_UTC, TIMESTAMP_LOCAL:
+		return nil
+	}
+	return fmt.Errorf("unknown time zone %q: must be %q or %q", zone, TIMESTAMP_UTC, TIMESTAMP_LOCAL)
+}
+
+// Prefixes every line written through it with the time its first byte
+// was received and/or a sequence number, as set by [CaptureConfig],
+// followed by a tag naming where the line came from, if any.
+//
+// Lines are never buffered, so there is no limit to their length:
+// a line split across writes is prefixed only once, where it starts.
+type LinePrefixer struct {
+	w io.Writer
+	// A Go layout, or "unix" or "unixms". Empty to skip timestamps.
+	layout string
+	loc    *time.Location
+	// The sequence number of the last line started, shared by the
+	// prefixers of a single file. Nil to skip sequence numbers.
+	seq *atomic.Uint64
+	// Written in brackets after the timestamp and sequence number. Optional.
+	tag string
+	// Whether the last write ended in the middle of a line.
+	mid bool
+	buf []byte
+}
+
+// Returns w itself if there is nothing to prefix. seq numbers the lines
+// if [CaptureConfig.sequence] is set, and may be shared by several prefixers.
+func newLinePrefixer(w io.Writer, c *CaptureConfig, seq *atomic.Uint64, tag string) io.Writer {
+	if c.timestampFormat == "" && !c.sequence && tag == "" {
+		return w
+	}
+	p := &LinePrefixer{w: w, loc: time.UTC, tag: tag}
+	if c.sequence {
+		p.seq = seq
+	}
+	if layout, ok := timestampFormats[c.timestampFormat]; ok {
+		p.layout = layout
+	} else {
+		p.layout = c.timestampFormat
+	}
+	if c.timestampZone == TIMESTAMP_LOCAL {
+		p.loc = time.Local
+	}
+	return p
+}
+
+// Writes b, prefixing every line starting within it, in a single write to the underlying writer.
+// Lines starting within the same write share a timestamp.
+func (p *LinePrefixer) Write(b []byte) (int, error) {
+	p.buf = p.buf[:0]
+	now := time.Now()
+	for rest := b; len(rest) > 0; {
+		if !p.mid {
+			p.buf = p.appendPrefix(p.buf, now)
+		}
+		end := bytes.IndexByte(rest, '\n') + 1
+		p.mid = end == 0
+		if p.mid {
+			end = len(rest)
+		}
+		p.buf = append(p.buf, rest[:end]...)
+		rest = rest[end:]
+	}
+	if _, err := p.w.Write(p.buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (p *LinePrefixer) appendPrefix(b []byte, now time.Time) []byte {
+	switch p.layout {
+	case "":
+	case "unix":
+		b = strconv.AppendInt(b, now.Unix(), 10)
+		b = append(b, ' ')
+	case "unixms":
+		b = strconv.AppendInt(b, now.UnixMilli(), 10)
+		b = append(b, ' ')
+	default:
+		b = now.In(p.loc).AppendFormat(b, p.layout)
+		b = append(b, ' ')
+	}
+	if p.seq != nil {
+		b = strconv.AppendUint(b, p.seq.Add(1), 10)
+		b = append(b, ' ')
+	}
+	if p.tag != "" {
+		b = append(b, '[')
+		b = append(b, p.tag...)
+		b = append(b, "] "...)
+	}
+	return b
+}
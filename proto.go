@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Protocol Buffers wire types, see https://protobuf.dev/programming-guides/encoding.
+const (
+	WIRE_VARINT  int = 0
+	WIRE_FIXED64 int = 1
+	WIRE_BYTES   int = 2
+	WIRE_FIXED32 int = 5
+)
+
+var errProtoTruncated = errors.New("truncated message")
+
+// Reads the fields of a Protocol Buffers message, one at a time.
+// Just enough of the wire format to decode known messages by hand.
+type ProtoReader struct {
+	b []byte
+}
+
+// Whether every field was read.
+func (r *ProtoReader) done() bool {
+	return len(r.b) == 0
+}
+
+// Reads the tag of the next field. Its value must be read with the method
+// matching the wire type, or skipped. Decoders skip known fields of an
+// unexpected wire type too, since reading them would misread the rest.
+func (r *ProtoReader) next() (field int, wire int, err error) {
+	tag, err := r.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	if tag>>3 == 0 || tag>>3 > 1<<29-1 {
+		return 0, 0, fmt.Errorf("invalid field number %d", tag>>3)
+	}
+	return int(tag >> 3), int(tag & 7), nil
+}
+
+func (r *ProtoReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		return 0, errProtoTruncated
+	}
+	r.b = r.b[n:]
+	return v, nil
+}
+
+func (r *ProtoReader) fixed64() (uint64, error) {
+	if len(r.b) < 8 {
+		return 0, errProtoTruncated
+	}
+	v := binary.LittleEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v, nil
+}
+
+func (r *ProtoReader) fixed32() (uint32, error) {
+	if len(r.b) < 4 {
+		return 0, errProtoTruncated
+	}
+	v := binary.LittleEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v, nil
+}
+
+// Reads a length-delimited value: a string, bytes or an embedded message.
+// The returned slice shares the underlying buffer.
+func (r *ProtoReader) bytes() ([]byte, error) {
+	n, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(r.b)) {
+		return nil, errProtoTruncated
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v, nil
+}
+
+// Reads an embedded message.
+func (r *ProtoReader) message() (*ProtoReader, error) {
+	b, err := r.bytes()
+	return &ProtoReader{b}, err
+}
+
+// Skips the value of a field of unknown number.
+func (r *ProtoReader) skip(wire int) (err error) {
+	switch wire {
+	case WIRE_VARINT:
+		_, err = r.varint()
+	case WIRE_FIXED64:
+		_, err = r.fixed64()
+	case WIRE_BYTES:
+		_, err = r.bytes()
+	case WIRE_FIXED32:
+		_, err = r.fixed32()
+	default:
+		// Groups are deprecated, and unused by the messages decoded here.
+		err = fmt.Errorf("unsupported wire type %d", wire)
+	}
+	return err
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Max size of a single NDJSON line pushed to [handlePush],
+// which must be read whole to be validated.
+const MAX_PUSH_JSON_LINE_SIZE int = 1 << 20
+
+// Content types pushed lines are validated as JSON for.
+var ndjsonTypes = []string{"application/x-ndjson", "application/ndjson", "application/jsonl"}
+
+// Content type of pushed bodies read whole as JSON, see [readPushedJSON].
+const JSON_TYPE string = "application/json"
+
+// Returned when a pushed NDJSON line exceeds [MAX_PUSH_JSON_LINE_SIZE].
+var errPushLineTooLong = errors.New("line too long")
+
+// Appends the body of "POST /ingest/<id>" to the capture file of id, a line
+// at a time, so that concurrent pushes to the same id don't interleave.
+// Bodies may be streamed, lines are written as they arrive.
+//
+// NDJSON bodies, as told by their content type, are validated and compacted line by line.
+// JSON bodies may span several lines, see [readPushedJSON].
+// The first invalid line ends the request, lines before it are kept.
+//
+// Replies once the capture file is listed, so that the path it's viewable at works right away.
+func handlePush(sr *ServerResources, w http.ResponseWriter, r *http.Request) {
+	tag := fmt.Sprintf("[%s]", r.URL.Path)
+	if !sr.beginPush(tag, w, r) {
+		return
+	}
+	defer sr.pushWg.Done()
+	id := strings.TrimPrefix(r.URL.Path, "/ingest/")
+	if err := validateCaptureId(id); err != nil {
+		sr.log.Printf("%s Bad request: %+v", tag, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f, err := sr.ingest.get(id)
+	if err != nil {
+		sr.log.Printf("%s Capture error: %+v", tag, err)
+		http.Error(w, "failed to open capture file", http.StatusInternalServerError)
+		return
+	}
+	defer sr.ingest.release(f)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isJSON := slices.Contains(ndjsonTypes, mediaType)
+	path := endpointPath(capturePathOf(sr.g, id, id))
+	sr.log.Printf("%s Receiving lines, JSON: %t", tag, isJSON || mediaType == JSON_TYPE)
+
+	lines := 0
+	var listed <-chan struct{}
+	out := f.writer(&sr.g.CaptureConfig, "")
+	write := func(line []byte) error {
+		if _, err := out.Write(line); err != nil {
+			return &WriteError{err}
+		}
+		if lines++; lines == 1 {
+			listed = sr.requestRescan(path)
+		}
+		return nil
+	}
+	if mediaType == JSON_TYPE {
+		err = readPushedJSON(r.Body, write)
+	} else {
+		err = readPushedLines(bufio.NewReaderSize(r.Body, LINE_BUFFER_SIZE), isJSON, write)
+	}
+	var werr *WriteError
+	switch {
+	case errors.As(err, &werr):
+		sr.log.Printf("%s Capture error after %d lines: %+v", tag, lines, err)
+		http.Error(w, "failed to write capture file", http.StatusInternalServerError)
+		return
+	case errors.Is(err, errPushLineTooLong):
+		sr.log.Printf("%s Rejected after %d lines: %+v", tag, lines, err)
+		http.Error(w, fmt.Sprintf("line %d: %s", lines+1, err), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		sr.log.Printf("%s Rejected after %d lines: %+v", tag, lines, err)
+		http.Error(w, fmt.Sprintf("line %d: %s", lines+1, err), http.StatusBadRequest)
+		return
+	}
+	sr.log.Printf("%s Captured %d lines.", tag, lines)
+	if listed != nil {
+		select {
+		case <-listed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if _, ok := (*sr.endpoints.Load())[path]; ok {
+		fmt.Fprintf(w, "Captured %d lines, viewable at %s\n", lines, path)
+	} else {
+		fmt.Fprintf(w, "Captured %d lines\n", lines)
+	}
+}
+
+// Checks that a push request may proceed, answering it otherwise, and registers it
+// so that capture files are only closed once it's done, see [ServerResources.closePush].
+// [ServerResources.pushWg] must be released when it returns true.
+func (sr *ServerResources) beginPush(tag string, w http.ResponseWriter, r *http.Request) bool {
+	if !sr.config().push {
+		sr.log.Printf("%s Push ingest disabled", tag)
+		http.NotFound(w, r)
+		return false
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	sr.pushMu.Lock()
+	defer sr.pushMu.Unlock()
+	if sr.pushClosed {
+		http.Error(w, errShutdown.Error(), http.StatusServiceUnavailable)
+		return false
+	}
+	sr.pushWg.Add(1)
+	return true
+}
+
+// Refuses new push requests and waits for running ones, for as long as ctx
+// allows, before closing the capture files they write to. Files are left
+// open if requests are still running when ctx is done.
+func (sr *ServerResources) closePush(ctx context.Context) error {
+	sr.pushMu.Lock()
+	sr.pushClosed = true
+	sr.pushMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		sr.pushWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return fmt.Errorf("push requests still running: %w", ctx.Err())
+	}
+	return sr.ingest.Close()
+}
+
+// Calls write with every JSON value in r, compacted into a line. Values
+// may span several lines, so r is read whole, up to [MAX_PUSH_JSON_LINE_SIZE].
+func readPushedJSON(r io.Reader, write func(line []byte) error) error {
+	b, err := io.ReadAll(io.LimitReader(r, int64(MAX_PUSH_JSON_LINE_SIZE)+1))
+	if err != nil {
+		return fmt.Errorf("read error: %w", err)
+	}
+	if len(b) > MAX_PUSH_JSON_LINE_SIZE {
+		return errPushLineTooLong
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	var compact bytes.Buffer
+	for {
+		var v json.RawMessage
+		if err := d.Decode(&v); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("invalid JSON: %w", err)
+		}
+		compact.Reset()
+		// Already validated, only whitespace is removed.
+		json.Compact(&compact, v)
+		compact.WriteByte('\n')
+		if err := write(compact.Bytes()); err != nil {
+			return err
+		}
+	}
+}
+
+// Calls write with every line read from r, each ending with a line break,
+// the last one included. Empty lines are skipped.
+// JSON lines are validated and compacted, others are passed as is.
+// Long lines are passed in several calls, unless they are JSON.
+func readPushedLines(r *bufio.Reader, isJSON bool, write func(line []byte) error) error {
+	var long []byte
+	var compact bytes.Buffer
+	// Whether the last call passed part of a longer line.
+	mid := false
+	for {
+		line, err := r.ReadSlice('\n')
+		if isJSON && len(long)+len(bytes.TrimSuffix(line, []byte("\n"))) > MAX_PUSH_JSON_LINE_SIZE {
+			return errPushLineTooLong
+		}
+		if err == bufio.ErrBufferFull && isJSON {
+			long = append(long, line...)
+			continue
+		}
+		if long != nil {
+			line, long = append(long, line...), nil
+		}
+		if err == io.EOF && len(line) > 0 && line[len(line)-1] != '\n' {
+			line = append(line, '\n')
+		}
+		switch {
+		case len(bytes.TrimSpace(line)) == 0 && !mid:
+		case isJSON:
+			compact.Reset()
+			if cerr := json.Compact(&compact, line); cerr != nil {
+				return fmt.Errorf("invalid JSON: %w", cerr)
+			}
+			compact.WriteByte('\n')
+			if werr := write(compact.Bytes()); werr != nil {
+				return werr
+			}
+		default:
+			if werr := write(line); werr != nil {
+				return werr
+			}
+			mid = err == bufio.ErrBufferFull
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return fmt.Errorf("read error: %w", err)
+		}
+	}
+}
+
+// Asks [watchSources] to re-scan the sources, unless path is already viewable.
+// Returns a channel closed once the sources were re-scanned, or nil if not needed.
+func (sr *ServerResources) requestRescan(path string) <-chan struct{} {
+	if _, ok := (*sr.endpoints.Load())[path]; ok {
+		return nil
+	}
+	done := make(chan struct{})
+	sr.rescanMu.Lock()
+	sr.rescanWaiters = append(sr.rescanWaiters, done)
+	sr.rescanMu.Unlock()
+	select {
+	case sr.rescan <- struct{}{}:
+	default:
+		// Already pending.
+	}
+	return done
+}
+
+// Re-scans the sources on request, then wakes up those waiting for it.
+func (sr *ServerResources) rescanRequested() {
+	sr.rescanMu.Lock()
+	waiters := sr.rescanWaiters
+	sr.rescanWaiters = nil
+	sr.rescanMu.Unlock()
+	refreshSources(sr, false)
+	for _, done := range waiters {
+		close(done)
+	}
+}
+
+// Whether [Globals.capturePath] must be added to the sources for pushed
+// files to be viewable, that is, if no source path contains it.
+func (sr *ServerResources) needsCaptureSource() bool {
+	if !sr.config().push {
+		return false
+	}
+	for _, src := range sr.rawSources {
+		if !src.valid {
+			continue
+		}
+		rel, err := filepath.Rel(src.absPath, sr.g.capturePath)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return false
+		}
+	}
+	return true
+}
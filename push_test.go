@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func postPush(sr *ServerResources, path string, contentType string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	handlePush(sr, w, r)
+	return w
+}
+
+func TestHandlePush(t *testing.T) {
+	long := strings.Repeat("x", MAX_PUSH_JSON_LINE_SIZE)
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		// The capture file, if created.
+		want string
+	}{
+		{"text", "text/plain", "a\n\nb\r\nc", http.StatusOK, "a\nb\r\nc\n"},
+		{"no content type", "", "a\n", http.StatusOK, "a\n"},
+		{"long text line", "", long + "\n", http.StatusOK, long + "\n"},
+		{"empty", "", "", http.StatusOK, ""},
+		{"NDJSON", "application/x-ndjson", "{\"a\": 1}\n\n[1, 2]\n", http.StatusOK, "{\"a\":1}\n[1,2]\n"},
+		{"NDJSON with parameters", "application/x-ndjson; charset=utf-8", "{\"a\": 1}", http.StatusOK, "{\"a\":1}\n"},
+		{"invalid NDJSON", "application/x-ndjson", "{\"a\": 1}\n{\"b\":\n2}\n", http.StatusBadRequest, "{\"a\":1}\n"},
+		{"NDJSON line too long", "application/x-ndjson", "1\n\"" + long + "\"\n", http.StatusRequestEntityTooLarge, "1\n"},
+		{"JSON across lines", "application/json", "{\n  \"a\": 1,\n  \"b\": [\n    2\n  ]\n}\n", http.StatusOK, "{\"a\":1,\"b\":[2]}\n"},
+		{"JSON values", "application/json", "{\"a\": 1}\n{\"a\": 2}", http.StatusOK, "{\"a\":1}\n{\"a\":2}\n"},
+		{"invalid JSON", "application/json", "{\"a\": 1}\n{\"a\"", http.StatusBadRequest, "{\"a\":1}\n"},
+		{"JSON too long", "application/json", "\"" + long + "\"", http.StatusRequestEntityTooLarge, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sr := newPushTestServer(t)
+			w := postPush(sr, "/ingest/web", tt.contentType, tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			want := map[string]string{"web.log": tt.want}
+			if got := readCaptures(t, sr); !reflect.DeepEqual(got, want) {
+				t.Errorf("captured %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestHandlePushViewable(t *testing.T) {
+	sr := newPushTestServer(t)
+	w := postPush(sr, "/ingest/web", "", "a\n")
+	path := endpointPath(capturePathOf(sr.g, "web", "web"))
+	if want := "Captured 1 lines, viewable at " + path + "\n"; w.Code != http.StatusOK || w.Body.String() != want {
+		t.Fatalf("got %d %q, want %q", w.Code, w.Body, want)
+	}
+	if _, ok := (*sr.endpoints.Load())[path]; !ok {
+		t.Errorf("%s not listed", path)
+	}
+	// Listed already.
+	if w := postPush(sr, "/ingest/web", "", "b\n"); !strings.Contains(w.Body.String(), "viewable at") {
+		t.Errorf("got %q", w.Body)
+	}
+	if got := readCaptures(t, sr)["web.log"]; got != "a\nb\n" {
+		t.Errorf("captured %q", got)
+	}
+}
+
+func TestHandlePushRejected(t *testing.T) {
+	sr := newPushTestServer(t)
+	for _, path := range []string{"/ingest/", "/ingest/../web", "/ingest/a/b", "/ingest/.web"} {
+		if w := postPush(sr, path, "", "a\n"); w.Code != http.StatusBadRequest {
+			t.Errorf("POST %s: status %d, want %d", path, w.Code, http.StatusBadRequest)
+		}
+	}
+	r := httptest.NewRequest(http.MethodGet, "/ingest/web", nil)
+	w := httptest.NewRecorder()
+	handlePush(sr, w, r)
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("GET: status %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+
+	cfg := *sr.config()
+	cfg.push = false
+	sr.cfg.Store(&cfg)
+	if w := postPush(sr, "/ingest/web", "", "a\n"); w.Code != http.StatusNotFound {
+		t.Errorf("push disabled: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if got := readCaptures(t, sr); len(got) > 0 {
+		t.Errorf("captured %q", got)
+	}
+}
+
+func TestReadPushedLines(t *testing.T) {
+	// The smallest buffer bufio allows.
+	const size = 16
+	long := strings.Repeat("x", size+4)
+	tests := []struct {
+		name   string
+		in     string
+		isJSON bool
+		want   []string
+		err    error
+	}{
+		{"long line in parts", "a\n" + long + "\n\n", false, []string{"a\n", long[:size], long[size:] + "\n"}, nil},
+		// A part of a long line that only holds white space is still passed.
+		{"long line ending in spaces", "x" + strings.Repeat(" ", size) + "\n", false,
+			[]string{"x" + strings.Repeat(" ", size-1), " \n"}, nil},
+		{"long JSON line whole", "[\"" + long + "\"]", true, []string{"[\"" + long + "\"]\n"}, nil},
+		{"JSON line at the limit", "\"" + strings.Repeat("x", MAX_PUSH_JSON_LINE_SIZE-2) + "\"\n", true,
+			[]string{"\"" + strings.Repeat("x", MAX_PUSH_JSON_LINE_SIZE-2) + "\"\n"}, nil},
+		{"JSON line too long", "\"" + strings.Repeat("x", MAX_PUSH_JSON_LINE_SIZE) + "\"\n", true, nil, errPushLineTooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			err := readPushedLines(bufio.NewReaderSize(strings.NewReader(tt.in), size), tt.isJSON, func(line []byte) error {
+				got = append(got, string(line))
+				return nil
+			})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
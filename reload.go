@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Requests a configuration reload on every SIGHUP.
+func handleReloads(sr *ServerResources) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		sr.log.Print("SIGHUP received, reloading configuration.")
+		select {
+		case sr.reload <- struct{}{}:
+		default:
+			// Already pending.
+		}
+	}
+}
+
+// Reads the configuration again, from the same arguments, environment
+// and configuration file as on startup, and applies it to the server.
+//
+// Source paths are resolved and scanned again, rebuilding the home page
+// and endpoints. Running streams are left alone, unless their source
+// is no longer served. New streams use the new configuration. Errors are
+// returned, never exiting, see [GlobalConfig.parseArgs].
+//
+// Must only run on the [watchSources] goroutine.
+func reloadConfig(sr *ServerResources) error {
+	var i Initializer
+	if _, err := i.loadConfig(os.Args[1:]); err != nil {
+		return err
+	}
+	old := sr.config()
+	next := i.ServerConfig
+	if next.port != old.port {
+		sr.log.Printf("Changing -port requires a restart, keeping %d.", old.port)
+		next.port = old.port
+	}
+	if next.followMode != old.followMode {
+		sr.log.Printf("Changing -follow requires a restart, keeping %q.", old.followMode)
+		next.followMode = old.followMode
+	}
+	if i.logging != sr.g.logging || i.captureLogs != sr.g.captureLogs {
+		sr.log.Print("Changing -l or -cl requires a restart, ignoring.")
+	}
+	if lc := sr.g.logCapture; lc != nil {
+		changed, err := lc.Reconfigure(i.rolling, i.rollingOptions())
+		if err != nil {
+			return fmt.Errorf("reopen log capture: %w", err)
+		}
+		if changed {
+			sr.log.Printf("Log capture reopened. Rolling: %t. Chunk size: %dMB. Rotation: %q.", i.rolling, i.logChunkSize, i.rotation)
+		}
+	}
+	sr.cfg.Store(&next)
+	if next.sourcePaths != old.sourcePaths || next.push != old.push {
+		resolveSources(sr)
+	}
+	refreshSources(sr, true)
+
+	served := make(map[string]bool)
+	for _, ep := range *sr.endpoints.Load() {
+		served[ep.vsd.path] = true
+	}
+	n := sr.stopStreams(func(s *Stream) bool { return !served[s.vsd.path] }, errSourceRemoved)
+	if n > 0 {
+		sr.log.Printf("Closed %d streams of sources no longer served.", n)
+	}
+	sr.log.Print("Configuration reloaded.")
+	return nil
+}
+
+// Logyard's own capture file, with -cl. Safe for concurrent use,
+// and reopened when reloads change its rolling settings.
+type LogCapture struct {
+	mu      sync.Mutex
+	w       io.Writer
+	path    string
+	rolling bool
+	opts    RollingOptions
+}
+
+func newLogCapture(path string, rolling bool, opts RollingOptions) (*LogCapture, error) {
+	lc := &LogCapture{path: path}
+	// Plain files start over with every process.
+	if err := lc.open(rolling, opts, os.O_TRUNC); err != nil {
+		return nil, err
+	}
+	return lc, nil
+}
+
+// Replaces the current writer, which must be locked unless
+// lc is still being created. mode is added to the flags of plain files.
+func (lc *LogCapture) open(rolling bool, opts RollingOptions, mode int) error {
+	var w io.Writer
+	if rolling {
+		w = getRollingLogger(lc.path, opts, true)
+	} else {
+		f, err := os.OpenFile(lc.path, os.O_WRONLY|os.O_CREATE|mode, 0666)
+		if err != nil {
+			return fmt.Errorf("create log file %q: %w", lc.path, err)
+		}
+		w = f
+	}
+	if c, ok := lc.w.(io.Closer); ok {
+		c.Close()
+	}
+	lc.w = w
+	lc.rolling = rolling
+	lc.opts = opts
+	return nil
+}
+
+func (lc *LogCapture) Write(p []byte) (int, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.w.Write(p)
+}
+
+// Reopens the file if the rolling settings changed, appending to it.
+// Returns whether it was reopened.
+func (lc *LogCapture) Reconfigure(rolling bool, opts RollingOptions) (bool, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if rolling == lc.rolling && (!rolling || opts == lc.opts) {
+		return false, nil
+	}
+	return true, lc.open(rolling, opts, os.O_APPEND)
+}
+
+// Closes the file. Nil captures are ignored,
+// and writes after closing fail.
+func (lc *LogCapture) Close() error {
+	if lc == nil {
+		return nil
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	c, ok := lc.w.(io.Closer)
+	lc.w = WriterFunc(func([]byte) (int, error) { return 0, os.ErrClosed })
+	if ok {
+		return c.Close()
+	}
+	return nil
+}
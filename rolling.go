@@ -0,0 +1,428 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Matches the backups created by lumberjack when rotating "<name>.log",
+// capturing "<name>" and the rotation timestamp. Backups may be compressed.
+var backupNameRegexp = regexp.MustCompile(`^(.+)-(\d{4}-\d{2}-\d{2}T\d{2}-\d{2}-\d{2}\.\d{3})\.log(\.gz)?$`)
+
+// Suffix of chunks compressed with [RollingOptions.compress].
+const COMPRESSED_SUFFIX string = ".gz"
+
+// Whether path names a rotated chunk compressed with gzip.
+// Compressed chunks are only served along with their active file.
+func isCompressedChunk(path string) bool {
+	_, _, ok := parseChunkName(filepath.Base(path))
+	return ok && strings.HasSuffix(path, COMPRESSED_SUFFIX)
+}
+
+// Returns the name a chunk had before being compressed, which cursors refer it by,
+// so that they remain valid when chunks are compressed after being streamed.
+func uncompressedName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), COMPRESSED_SUFFIX)
+}
+
+// Reports the uncompressed size of a compressed chunk, so that offsets
+// into a rolling set don't depend on which of its chunks are compressed.
+type compressedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i compressedInfo) Size() int64 { return i.size }
+
+// Returns the uncompressed size of the gzip file at path,
+// as recorded in its trailer. Only valid for files under 4GB.
+func gzipSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var trailer [4]byte
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() < 18 {
+		return 0, fmt.Errorf("truncated gzip file %q", path)
+	}
+	if _, err := f.ReadAt(trailer[:], info.Size()-4); err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint32(trailer[:])), nil
+}
+
+// Opens a chunk for reading, decompressing it if needed.
+func openChunk(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil || !strings.HasSuffix(path, COMPRESSED_SUFFIX) {
+		return f, err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("open %q: %w", path, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, f}, nil
+}
+
+// A compressed chunk inflated into a temporary file, which unlike a gzip
+// stream can be read at any offset. The file is removed once closed.
+type InflatedChunk struct {
+	*os.File
+}
+
+// Decompresses the chunk at path into a temporary file, a block at a time.
+func inflateChunk(path string) (*InflatedChunk, error) {
+	r, err := openChunk(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	f, err := os.CreateTemp("", "logyard-chunk-*.log")
+	if err != nil {
+		return nil, fmt.Errorf("inflate %q: %w", path, err)
+	}
+	c := &InflatedChunk{f}
+	if _, err := io.Copy(f, r); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("decompress %q: %w", path, err)
+	}
+	return c, nil
+}
+
+func (c *InflatedChunk) Close() error {
+	err := c.File.Close()
+	os.Remove(c.Name())
+	return err
+}
+
+// Returns the name of the active file a rotated chunk belongs to,
+// and a key that sorts chunks of the same set chronologically.
+func parseChunkName(name string) (active string, key string, ok bool) {
+	m := backupNameRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1] + ".log", m[2], true
+}
+
+// Folds rotated chunks into the [ValidSourceDescriptor.chunks]
+// of their active file, when the active file is also present.
+// Chunks without an active file are left as regular sources,
+// unless compressed, in which case they are dropped.
+func groupRollingSets(sources []ValidSourceDescriptor) []ValidSourceDescriptor {
+	active := make(map[string]int)
+	for i, vsd := range sources {
+		active[vsd.path] = i
+	}
+	grouped := make([]ValidSourceDescriptor, 0, len(sources))
+	chunks := make(map[string][]ValidSourceDescriptor)
+	for _, vsd := range sources {
+		name, _, ok := parseChunkName(filepath.Base(vsd.path))
+		if ok {
+			path := filepath.Join(filepath.Dir(vsd.path), name)
+			if _, found := active[path]; found {
+				chunks[path] = append(chunks[path], vsd)
+				continue
+			}
+		}
+		if isCompressedChunk(vsd.path) {
+			continue
+		}
+		grouped = append(grouped, vsd)
+	}
+	for i := range grouped {
+		if c, ok := chunks[grouped[i].path]; ok {
+			sortChunks(c)
+			grouped[i].chunks = c
+		}
+	}
+	return grouped
+}
+
+// Lists the rotated chunks of the active file at path, oldest first.
+func findChunks(path string) ([]ValidSourceDescriptor, error) {
+	dir, base := filepath.Split(path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+	var chunks []ValidSourceDescriptor
+	for _, e := range entries {
+		if name, _, ok := parseChunkName(e.Name()); !ok || name != base || e.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(e.Name(), COMPRESSED_SUFFIX) && names[uncompressedName(e.Name())] {
+			// Still being compressed.
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if strings.HasSuffix(e.Name(), COMPRESSED_SUFFIX) {
+			size, err := gzipSize(filepath.Join(dir, e.Name()))
+			if err != nil {
+				// Likely being written, listed once complete.
+				continue
+			}
+			info = compressedInfo{info, size}
+		}
+		chunks = append(chunks, ValidSourceDescriptor{
+			path: filepath.Join(dir, e.Name()),
+			info: info,
+		})
+	}
+	sortChunks(chunks)
+	return chunks, nil
+}
+
+func sortChunks(chunks []ValidSourceDescriptor) {
+	slices.SortFunc(chunks, func(a, b ValidSourceDescriptor) int {
+		_, ka, _ := parseChunkName(filepath.Base(a.path))
+		_, kb, _ := parseChunkName(filepath.Base(b.path))
+		return strings.Compare(ka, kb)
+	})
+}
+
+// Periods of time-based rotation, see [BaseConfig.rotation].
+const (
+	ROTATE_HOURLY string = "hourly"
+	ROTATE_DAILY  string = "daily"
+)
+
+func validateRotation(rotation string) error {
+	switch rotation {
+	case "", ROTATE_HOURLY, ROTATE_DAILY:
+		return nil
+	}
+	return fmt.Errorf("unknown rotation %q: must be empty, %q or %q", rotation, ROTATE_HOURLY, ROTATE_DAILY)
+}
+
+// Layout of the timestamp in the name of rotated chunks, as used by lumberjack.
+const BACKUP_TIME_FORMAT string = "2006-01-02T15-04-05.000"
+
+// Settings of rolling log files, taken from [BaseConfig].
+// Files must be reopened whenever they change.
+type RollingOptions struct {
+	chunkSize  int
+	rotation   string
+	maxBackups int
+	maxAge     int
+	diskBudget int
+	compress   bool
+}
+
+func (c *BaseConfig) rollingOptions() RollingOptions {
+	return RollingOptions{
+		chunkSize:  c.logChunkSize,
+		rotation:   c.rotation,
+		maxBackups: c.maxBackups,
+		maxAge:     c.maxAge,
+		diskBudget: c.diskBudget,
+		compress:   c.compress,
+	}
+}
+
+// A lumberjack logger rotated by size and, optionally, whenever a new hour
+// or day starts in UTC, whichever comes first. Rotations are handled here
+// rather than by lumberjack, so that [RollingOptions.diskBudget] is enforced
+// after each of them. Lumberjack still removes and compresses old chunks.
+//
+// Chunks are named after the time they were rotated, as with lumberjack,
+// which for time-based rotations is exactly the start of the new period:
+// the chunk holding the lines of 2006-01-02 is "<name>-2006-01-03T00-00-00.000.log".
+type RollingWriter struct {
+	mu sync.Mutex
+	l  *lumberjack.Logger
+	// Max size of the active file in bytes, or zero to rotate by time alone.
+	max int64
+	// Zero to rotate by size alone.
+	period time.Duration
+	// Max size of the files in the directory of the active file, in bytes. Zero for no limit.
+	budget int64
+	// Whether the directory is shared with other captures, see [enforceDiskBudget].
+	shared bool
+	// When the active file must be rotated, if [RollingWriter.period] is set.
+	end time.Time
+	// Size of the active file. Only valid once started.
+	size    int64
+	started bool
+	// Returns the current time, [time.Now] but in tests.
+	now func() time.Time
+}
+
+func newRollingWriter(l *lumberjack.Logger, opts RollingOptions, shared bool) *RollingWriter {
+	w := &RollingWriter{
+		l:      l,
+		shared: shared,
+		max:    int64(max(opts.chunkSize, 0)) << 20,
+		budget: int64(max(opts.diskBudget, 0)) << 20,
+		now:    time.Now,
+	}
+	switch opts.rotation {
+	case ROTATE_HOURLY:
+		w.period = time.Hour
+	case ROTATE_DAILY:
+		w.period = 24 * time.Hour
+	}
+	return w
+}
+
+func (w *RollingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.now()
+	if !w.started {
+		w.started = true
+		w.end = w.periodEnd(now)
+		if info, err := os.Stat(w.l.Filename); err == nil {
+			w.size = info.Size()
+			// The active file may be left over from an earlier period.
+			if end := w.periodEnd(info.ModTime()); w.size > 0 && end.Before(w.end) {
+				w.end = end
+			}
+		}
+	}
+	var err error
+	if w.period > 0 && !now.Before(w.end) {
+		err = w.rotateAt(w.end)
+		w.end = w.periodEnd(now)
+	} else if w.max > 0 && w.size > 0 && w.size+int64(len(p)) > w.max {
+		err = w.rotateAt(now)
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.l.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Returns the start of the period following the one t belongs to.
+func (w *RollingWriter) periodEnd(t time.Time) time.Time {
+	if w.period == 0 {
+		return time.Time{}
+	}
+	// Truncation is relative to the zero time, in UTC.
+	return t.UTC().Truncate(w.period).Add(w.period)
+}
+
+// Renames the active file after t. The next write opens a new one.
+func (w *RollingWriter) rotateAt(t time.Time) error {
+	if err := w.l.Close(); err != nil {
+		return err
+	}
+	w.size = 0
+	dir, base := filepath.Split(w.l.Filename)
+	name := filepath.Join(dir, strings.TrimSuffix(base, ".log")+"-"+t.UTC().Format(BACKUP_TIME_FORMAT)+".log")
+	if _, err := os.Stat(name); err == nil {
+		// Taken already, let lumberjack pick the current time.
+		if err := w.l.Rotate(); err != nil {
+			return err
+		}
+	} else if err := os.Rename(w.l.Filename, name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("rotate %q: %w", w.l.Filename, err)
+	}
+	if w.budget > 0 {
+		// Leaving room for the new active file to grow.
+		if err := enforceDiskBudget(w.l.Filename, w.budget-w.max, w.shared); err != nil {
+			log.Printf("Failed to enforce the disk budget of %q: %+v", w.l.Filename, err)
+		}
+	}
+	return nil
+}
+
+func (w *RollingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.l.Close()
+}
+
+// Removes the oldest rotated chunks in the directory of the active file at path,
+// of any rolling set, until the log files there take at most budget bytes.
+// Active files are kept. In a shared directory, such as the capture directory
+// holding Logyard's own logs with -cl, only the set of path is counted.
+func enforceDiskBudget(path string, budget int64, shared bool) error {
+	dir := filepath.Dir(path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	// Listed even before being created again, so that chunks are grouped with it.
+	sources := []ValidSourceDescriptor{{path: path}}
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".log") && !isCompressedChunk(p) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			// Removed or compressed in the meantime.
+			continue
+		}
+		if p == path {
+			sources[0].info = info
+			continue
+		}
+		sources = append(sources, ValidSourceDescriptor{path: p, info: info})
+	}
+	var files, chunks []ValidSourceDescriptor
+	if shared {
+		for _, vsd := range groupRollingSets(sources) {
+			if vsd.path == path {
+				files, chunks = slices.Concat(vsd.chunks, []ValidSourceDescriptor{vsd}), vsd.chunks
+			}
+		}
+	} else {
+		files = sources
+		for _, vsd := range sources {
+			if _, _, ok := parseChunkName(filepath.Base(vsd.path)); ok {
+				chunks = append(chunks, vsd)
+			}
+		}
+		sortChunks(chunks)
+	}
+	var total int64
+	for _, f := range files {
+		if f.info != nil {
+			total += f.info.Size()
+		}
+	}
+	for _, c := range chunks {
+		if total <= budget {
+			break
+		}
+		if err := os.Remove(c.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		total -= c.info.Size()
+	}
+	return nil
+}
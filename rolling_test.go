@@ -0,0 +1,336 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Creates files of the given sizes in dir, returning dir.
+func writeFiles(t *testing.T, dir string, files map[string]int) string {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(strings.Repeat("x", size)), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestEnforceDiskBudget(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  map[string]int
+		active string
+		budget int64
+		shared bool
+		want   []string
+	}{
+		{
+			name: "every set in the directory",
+			files: map[string]int{
+				"out.log": 100, "out-2024-01-01T00-00-00.000.log": 100, "out-2024-01-03T00-00-00.000.log": 100,
+				"err.log": 100, "err-2024-01-02T00-00-00.000.log": 100,
+			},
+			active: "out.log", budget: 350,
+			want: []string{"err.log", "out-2024-01-03T00-00-00.000.log", "out.log"},
+		},
+		{
+			name: "compressed and orphaned chunks",
+			files: map[string]int{
+				"out.log": 100, "out-2024-01-01T00-00-00.000.log.gz": 50,
+				"gone-2024-01-02T00-00-00.000.log": 100, "out-2024-01-03T00-00-00.000.log": 100,
+			},
+			active: "out.log", budget: 200,
+			want: []string{"out-2024-01-03T00-00-00.000.log", "out.log"},
+		},
+		{
+			name:   "within the budget",
+			files:  map[string]int{"out.log": 100, "out-2024-01-01T00-00-00.000.log": 100, "notes.txt": 1000},
+			active: "out.log", budget: 200,
+			want: []string{"notes.txt", "out-2024-01-01T00-00-00.000.log", "out.log"},
+		},
+		{
+			name: "active file not created yet",
+			files: map[string]int{
+				"out-2024-01-01T00-00-00.000.log": 100, "out-2024-01-02T00-00-00.000.log": 100,
+			},
+			active: "out.log", budget: 100,
+			want: []string{"out-2024-01-02T00-00-00.000.log"},
+		},
+		{
+			name: "shared directory",
+			files: map[string]int{
+				"1-logyard.log": 100, "1-logyard-2024-01-01T00-00-00.000.log": 100, "1-logyard-2024-01-02T00-00-00.000.log": 100,
+				"other.log": 1000, "other-2023-01-01T00-00-00.000.log": 100,
+			},
+			active: "1-logyard.log", budget: 150, shared: true,
+			want: []string{"1-logyard.log", "other-2023-01-01T00-00-00.000.log", "other.log"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeFiles(t, t.TempDir(), tt.files)
+			if err := enforceDiskBudget(filepath.Join(dir, tt.active), tt.budget, tt.shared); err != nil {
+				t.Fatal(err)
+			}
+			if got := listFiles(t, dir); !slices.Equal(got, tt.want) {
+				t.Errorf("left %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseChunkName(t *testing.T) {
+	tests := []struct {
+		name   string
+		active string
+		key    string
+		ok     bool
+	}{
+		{"app-2024-05-01T12-00-00.000.log", "app.log", "2024-05-01T12-00-00.000", true},
+		{"app-2024-05-01T12-00-00.000.log.gz", "app.log", "2024-05-01T12-00-00.000", true},
+		{"my-app-2024-05-01T12-00-00.000.log", "my-app.log", "2024-05-01T12-00-00.000", true},
+		{"app-2024-05-01T12-00-00.000-2024-05-02T12-00-00.000.log", "app-2024-05-01T12-00-00.000.log", "2024-05-02T12-00-00.000", true},
+		{"app.log", "", "", false},
+		{"-2024-05-01T12-00-00.000.log", "", "", false},
+		{"app-2024-05-01T12-00-00.log", "", "", false},
+		{"app-2024-05-01T12:00:00.000.log", "", "", false},
+		{"app-2024-05-01T12-00-00.000.txt", "", "", false},
+		{"app-2024-05-01T12-00-00.000.log.zip", "", "", false},
+	}
+	for _, tt := range tests {
+		active, key, ok := parseChunkName(tt.name)
+		if active != tt.active || key != tt.key || ok != tt.ok {
+			t.Errorf("parseChunkName(%q) = %q, %q, %t, want %q, %q, %t", tt.name, active, key, ok, tt.active, tt.key, tt.ok)
+		}
+	}
+}
+
+func TestGroupRollingSets(t *testing.T) {
+	sources := func(paths ...string) []ValidSourceDescriptor {
+		var s []ValidSourceDescriptor
+		for _, p := range paths {
+			s = append(s, ValidSourceDescriptor{path: p})
+		}
+		return s
+	}
+	type set struct {
+		path   string
+		chunks []string
+	}
+	tests := []struct {
+		name    string
+		sources []ValidSourceDescriptor
+		want    []set
+	}{
+		{"no chunks", sources("/a/app.log", "/a/db.log"), []set{{"/a/app.log", nil}, {"/a/db.log", nil}}},
+		{"chunks sorted under their active file", sources(
+			"/a/app-2024-05-02T00-00-00.000.log", "/a/app.log", "/a/app-2024-05-01T00-00-00.000.log.gz", "/a/db.log",
+		), []set{
+			{"/a/app.log", []string{"/a/app-2024-05-01T00-00-00.000.log.gz", "/a/app-2024-05-02T00-00-00.000.log"}},
+			{"/a/db.log", nil},
+		}},
+		{"chunks without an active file", sources(
+			"/a/app-2024-05-01T00-00-00.000.log", "/a/app-2024-05-02T00-00-00.000.log.gz",
+		), []set{{"/a/app-2024-05-01T00-00-00.000.log", nil}}},
+		{"active file in another directory", sources(
+			"/a/app.log", "/b/app-2024-05-01T00-00-00.000.log", "/b/app-2024-05-02T00-00-00.000.log.gz",
+		), []set{{"/a/app.log", nil}, {"/b/app-2024-05-01T00-00-00.000.log", nil}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []set
+			for _, vsd := range groupRollingSets(tt.sources) {
+				s := set{path: vsd.path}
+				for _, c := range vsd.chunks {
+					s.chunks = append(s.chunks, c.path)
+				}
+				got = append(got, s)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortChunks(t *testing.T) {
+	chunks := []ValidSourceDescriptor{
+		{path: "/a/app-2024-05-01T10-00-00.000.log"},
+		{path: "/a/app-2023-12-31T23-59-59.999.log.gz"},
+		{path: "/a/app-2024-05-01T09-00-00.500.log"},
+		{path: "/a/app-2024-05-01T09-00-00.050.log.gz"},
+	}
+	sortChunks(chunks)
+	var got []string
+	for _, c := range chunks {
+		got = append(got, filepath.Base(c.path))
+	}
+	want := []string{
+		"app-2023-12-31T23-59-59.999.log.gz",
+		"app-2024-05-01T09-00-00.050.log.gz",
+		"app-2024-05-01T09-00-00.500.log",
+		"app-2024-05-01T10-00-00.000.log",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRollingWriterRotation(t *testing.T) {
+	at := func(day, hour, min int) time.Time { return time.Date(2024, 5, day, hour, min, 0, 0, time.UTC) }
+	type write struct {
+		at   time.Time
+		line string
+	}
+	tests := []struct {
+		name     string
+		rotation string
+		// Size in bytes, zero to rotate by time alone.
+		max    int64
+		writes []write
+		// Contents of each file left, by name.
+		want map[string]string
+	}{
+		{"hourly", ROTATE_HOURLY, 0, []write{
+			{at(1, 10, 0), "a\n"}, {at(1, 10, 59), "b\n"}, {at(1, 11, 0), "c\n"}, {at(1, 13, 30), "d\n"},
+		}, map[string]string{
+			"app-2024-05-01T11-00-00.000.log": "a\nb\n",
+			"app-2024-05-01T12-00-00.000.log": "c\n",
+			"app.log":                         "d\n",
+		}},
+		{"daily", ROTATE_DAILY, 0, []write{
+			{at(1, 0, 0), "a\n"}, {at(1, 23, 59), "b\n"}, {at(2, 0, 0), "c\n"},
+		}, map[string]string{
+			"app-2024-05-02T00-00-00.000.log": "a\nb\n",
+			"app.log":                         "c\n",
+		}},
+		{"by size", "", 4, []write{
+			{at(1, 10, 0), "a\n"}, {at(1, 10, 1), "b\n"}, {at(1, 10, 2), "c\n"},
+		}, map[string]string{
+			"app-2024-05-01T10-02-00.000.log": "a\nb\n",
+			"app.log":                         "c\n",
+		}},
+		{"by size before the period ends", ROTATE_DAILY, 4, []write{
+			{at(1, 10, 0), "a\n"}, {at(1, 10, 1), "b\n"}, {at(1, 10, 2), "c\n"}, {at(2, 0, 0), "d\n"},
+		}, map[string]string{
+			"app-2024-05-01T10-02-00.000.log": "a\nb\n",
+			"app-2024-05-02T00-00-00.000.log": "c\n",
+			"app.log":                         "d\n",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			w := newTestRollingWriter(filepath.Join(dir, "app.log"), tt.rotation)
+			w.max = tt.max
+			for _, wr := range tt.writes {
+				w.now = func() time.Time { return wr.at }
+				if _, err := w.Write([]byte(wr.line)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := readFiles(t, dir); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRollingWriterLeftOver(t *testing.T) {
+	dir := writeFiles(t, t.TempDir(), map[string]int{"app.log": 2})
+	path := filepath.Join(dir, "app.log")
+	// Last written two days before starting again.
+	modified := time.Date(2024, 5, 1, 15, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	w := newTestRollingWriter(path, ROTATE_DAILY)
+	w.now = func() time.Time { return modified.Add(48 * time.Hour) }
+	if _, err := w.Write([]byte("a\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"app-2024-05-02T00-00-00.000.log": "xx", "app.log": "a\n"}
+	if got := readFiles(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRollingWriterNameTaken(t *testing.T) {
+	dir := writeFiles(t, t.TempDir(), map[string]int{"app-2024-05-01T11-00-00.000.log": 2})
+	w := newTestRollingWriter(filepath.Join(dir, "app.log"), ROTATE_HOURLY)
+	for _, wr := range []struct {
+		at   time.Time
+		line string
+	}{
+		{time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), "a\n"},
+		{time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC), "b\n"},
+	} {
+		w.now = func() time.Time { return wr.at }
+		if _, err := w.Write([]byte(wr.line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := readFiles(t, dir)
+	if len(got) != 3 || got["app-2024-05-01T11-00-00.000.log"] != "xx" || got["app.log"] != "b\n" {
+		t.Fatalf("got %q", got)
+	}
+	// Named by lumberjack after the actual time instead.
+	for name, content := range got {
+		if _, _, ok := parseChunkName(name); ok && content == "a\n" {
+			return
+		}
+	}
+	t.Errorf("rotated lines lost: %q", got)
+}
+
+func newTestRollingWriter(path string, rotation string) *RollingWriter {
+	return newRollingWriter(&lumberjack.Logger{Filename: path, MaxSize: math.MaxInt32}, RollingOptions{rotation: rotation}, false)
+}
+
+// Returns the contents of every file in dir, by name.
+func readFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	for _, name := range listFiles(t, dir) {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[name] = string(b)
+	}
+	return files
+}
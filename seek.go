@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Size of the blocks read when scanning a source backwards.
+const SEEK_BLOCK_SIZE int = 32 << 10
+
+// Where a stream starts, as requested by the client through
+// the query parameters of the "/src/.../$" endpoint:
+//
+//   - "tail=N": the last N lines.
+//   - "offset=B": the line containing byte B of the source. Negative
+//     values count from the end. Rolling sets are addressed as if
+//     all their chunks were a single file.
+//   - "time=T": the first line with a timestamp at or after T, an
+//     RFC 3339 date. Lines are assumed to be in chronological order.
+//   - "from=start" (default) or "from=end": the first byte, or only
+//     the lines written after connecting.
+//   - "resume=C": right after the line a [Cursor] C was sent with,
+//     so reconnecting clients only receive what they missed.
+//
+// At most one of them may be provided.
+type StartRequest struct {
+	tail   int
+	offset int64
+	time   time.Time
+	cursor Cursor
+	// Which of the above was requested. Zero value starts from the first byte.
+	mode StartMode
+}
+
+type StartMode int
+
+const (
+	START_BEGINNING StartMode = iota
+	START_TAIL
+	START_OFFSET
+	START_END
+	START_TIME
+	START_RESUME
+)
+
+func parseStartRequest(q url.Values) (req StartRequest, err error) {
+	set := 0
+	if v := q.Get("tail"); v != "" {
+		set++
+		req.mode = START_TAIL
+		if req.tail, err = strconv.Atoi(v); err != nil || req.tail < 0 {
+			return req, fmt.Errorf("invalid tail %q: must be a non-negative integer", v)
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		set++
+		req.mode = START_OFFSET
+		if req.offset, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return req, fmt.Errorf("invalid offset %q: must be an integer", v)
+		}
+	}
+	if v := q.Get("time"); v != "" {
+		set++
+		req.mode = START_TIME
+		if req.time, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return req, fmt.Errorf("invalid time %q: must be an RFC 3339 date", v)
+		}
+	}
+	if v := q.Get("resume"); v != "" {
+		set++
+		req.mode = START_RESUME
+		if req.cursor, err = parseCursor(v); err != nil {
+			return req, err
+		}
+	}
+	switch v := q.Get("from"); v {
+	case "", "start":
+	case "end":
+		set++
+		req.mode = START_END
+	default:
+		return req, fmt.Errorf("invalid from %q: must be \"start\" or \"end\"", v)
+	}
+	if set > 1 {
+		return req, errors.New("only one of tail, offset, time, resume or from may be provided")
+	}
+	return req, nil
+}
+
+// Identifies the end of a streamed line, in a way that survives
+// rotations and the removal of old chunks: files are referred to by
+// name, and the line itself is checksummed so it can be found again
+// after the active file has been renamed.
+//
+// Formatted as "<file name>:<offset>:<checksum>", where offset
+// is within the named file and checksum is the hex CRC-32 (IEEE)
+// of the line ending at that offset.
+type Cursor struct {
+	file   string
+	offset int64
+	crc    uint32
+}
+
+func (c Cursor) String() string {
+	return fmt.Sprintf("%s:%d:%08x", c.file, c.offset, c.crc)
+}
+
+func parseCursor(v string) (c Cursor, err error) {
+	invalid := fmt.Errorf("invalid resume cursor %q", v)
+	// File names may contain colons, the numbers may not.
+	rest, sum, ok := cutLast(v, ":")
+	if !ok {
+		return c, invalid
+	}
+	file, offset, ok := cutLast(rest, ":")
+	if !ok || file == "" {
+		return c, invalid
+	}
+	if c.offset, err = strconv.ParseInt(offset, 10, 64); err != nil || c.offset < 0 {
+		return c, invalid
+	}
+	crc, err := strconv.ParseUint(sum, 16, 32)
+	if err != nil {
+		return c, invalid
+	}
+	c.file = file
+	c.crc = uint32(crc)
+	return c, nil
+}
+
+func cutLast(s string, sep string) (before string, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// Returned by [SourceFiles.findCursor] when no file matches a cursor.
+var errCursorNotFound = errors.New("resume cursor not found in source")
+
+// Finds the position right after the line identified by c.
+//
+// The named file is checked first, then every other file from newest
+// to oldest, since the active file may have been rotated under a new name.
+func (sf *SourceFiles) findCursor(c Cursor) (StreamPosition, error) {
+	var candidates []int
+	for i := len(sf.paths) - 1; i >= 0; i-- {
+		if uncompressedName(sf.paths[i]) == c.file {
+			candidates = append([]int{i}, candidates...)
+		} else {
+			candidates = append(candidates, i)
+		}
+	}
+	for _, i := range candidates {
+		if c.offset > sf.sizes[i] {
+			continue
+		}
+		pos := StreamPosition{file: i, offset: c.offset}
+		if c.offset == 0 {
+			if uncompressedName(sf.paths[i]) == c.file {
+				return pos, nil
+			}
+			continue
+		}
+		sum, err := sf.lineChecksum(pos)
+		if err != nil {
+			return pos, err
+		}
+		if sum == c.crc {
+			return pos, nil
+		}
+	}
+	return StreamPosition{}, errCursorNotFound
+}
+
+// Returns the checksum of the line ending right before pos.
+func (sf *SourceFiles) lineChecksum(pos StreamPosition) (uint32, error) {
+	end := sf.logical(pos)
+	// The line's own break is right before pos, look for the one before it.
+	start, err := sf.lineStartBefore(sf.position(max(end-1, 0)), 1)
+	if err != nil {
+		return 0, err
+	}
+	crc := crc32.NewIEEE()
+	buf := make([]byte, SEEK_BLOCK_SIZE)
+	for offset := sf.logical(start); offset < end; {
+		n, err := sf.readLogical(buf[:min(int64(len(buf)), end-offset)], offset)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			break
+		}
+		crc.Write(buf[:n])
+		offset += int64(n)
+	}
+	return crc.Sum32(), nil
+}
+
+// A position within a logical source: the index of a file
+// in [SourceFiles] and an offset within that file.
+type StreamPosition struct {
+	file   int
+	offset int64
+}
+
+// The files making up a logical source, oldest first.
+// The last one is the active file, which is kept open by its stream.
+//
+// Compressed chunks are inflated into temporary files when first needed,
+// since gzip doesn't allow seeking, and kept until sf is closed.
+type SourceFiles struct {
+	paths []string
+	sizes []int64
+	// Handles opened while scanning, by file index.
+	open map[int]*os.File
+	// Compressed chunks inflated while scanning, by file index.
+	inflated map[int]*InflatedChunk
+}
+
+func newSourceFiles(chunks []ValidSourceDescriptor, active *os.File) (*SourceFiles, error) {
+	info, err := active.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sf := &SourceFiles{open: make(map[int]*os.File), inflated: make(map[int]*InflatedChunk)}
+	for _, c := range chunks {
+		sf.paths = append(sf.paths, c.path)
+		sf.sizes = append(sf.sizes, c.info.Size())
+	}
+	sf.paths = append(sf.paths, active.Name())
+	sf.sizes = append(sf.sizes, info.Size())
+	sf.open[len(sf.paths)-1] = active
+	return sf, nil
+}
+
+// Closes every file opened by sf, except for the active one.
+func (sf *SourceFiles) Close() {
+	for i, f := range sf.open {
+		if i != len(sf.paths)-1 {
+			f.Close()
+		}
+	}
+	for _, c := range sf.inflated {
+		c.Close()
+	}
+}
+
+// Hands over the inflated copy of the i-th file, if any,
+// which is then left open by [SourceFiles.Close].
+func (sf *SourceFiles) takeInflated(i int) *InflatedChunk {
+	c := sf.inflated[i]
+	delete(sf.inflated, i)
+	return c
+}
+
+func (sf *SourceFiles) end() StreamPosition {
+	last := len(sf.paths) - 1
+	return StreamPosition{file: last, offset: sf.sizes[last]}
+}
+
+func (sf *SourceFiles) readAt(i int, p []byte, off int64) (int, error) {
+	if strings.HasSuffix(sf.paths[i], COMPRESSED_SUFFIX) {
+		return sf.readCompressedAt(i, p, off)
+	}
+	f, ok := sf.open[i]
+	if !ok {
+		var err error
+		if f, err = os.Open(sf.paths[i]); err != nil {
+			return 0, err
+		}
+		sf.open[i] = f
+	}
+	n, err := f.ReadAt(p, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (sf *SourceFiles) readCompressedAt(i int, p []byte, off int64) (int, error) {
+	c, ok := sf.inflated[i]
+	if !ok {
+		var err error
+		if c, err = inflateChunk(sf.paths[i]); err != nil {
+			return 0, err
+		}
+		sf.inflated[i] = c
+	}
+	n, err := c.ReadAt(p, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Converts an offset into the concatenation of all files to a position.
+// Offsets past the end are clamped to it.
+func (sf *SourceFiles) position(offset int64) StreamPosition {
+	for i, size := range sf.sizes {
+		if offset < size {
+			return StreamPosition{file: i, offset: offset}
+		}
+		offset -= size
+	}
+	return sf.end()
+}
+
+func (sf *SourceFiles) total() (total int64) {
+	for _, size := range sf.sizes {
+		total += size
+	}
+	return total
+}
+
+// Scans backwards from pos (exclusive) for the n-th line break,
+// returning the position right after it.
+// If there are fewer than n line breaks, returns the first position.
+func (sf *SourceFiles) lineStartBefore(pos StreamPosition, n int) (StreamPosition, error) {
+	if n <= 0 {
+		return pos, nil
+	}
+	buf := make([]byte, SEEK_BLOCK_SIZE)
+	for i := pos.file; i >= 0; i-- {
+		end := sf.sizes[i]
+		if i == pos.file {
+			end = pos.offset
+		}
+		for end > 0 {
+			start := max(end-int64(len(buf)), 0)
+			block := buf[:end-start]
+			read, err := sf.readAt(i, block, start)
+			if err != nil {
+				return pos, fmt.Errorf("read %q: %w", sf.paths[i], err)
+			}
+			block = block[:read]
+			for j := bytes.LastIndexByte(block, '\n'); j >= 0; j = bytes.LastIndexByte(block[:j], '\n') {
+				if n--; n == 0 {
+					return StreamPosition{file: i, offset: start + int64(j) + 1}, nil
+				}
+			}
+			end = start
+		}
+	}
+	return StreamPosition{}, nil
+}
+
+// Resolves req to a position, aligned to the start of a line.
+func (sf *SourceFiles) resolve(req StartRequest) (StreamPosition, error) {
+	switch req.mode {
+	case START_END:
+		return sf.end(), nil
+	case START_TAIL:
+		end := sf.end()
+		n := req.tail
+		// A line break at the very end terminates the last line, it doesn't start a new one.
+		if last, err := sf.lastByte(); err != nil {
+			return end, err
+		} else if last == '\n' {
+			n++
+		}
+		if req.tail == 0 {
+			return end, nil
+		}
+		return sf.lineStartBefore(end, n)
+	case START_OFFSET:
+		offset := req.offset
+		if offset < 0 {
+			offset = max(sf.total()+offset, 0)
+		}
+		return sf.lineStartBefore(sf.position(offset), 1)
+	case START_TIME:
+		offset, err := sf.seekTime(req.time)
+		return sf.position(offset), err
+	case START_RESUME:
+		return sf.findCursor(req.cursor)
+	}
+	return StreamPosition{}, nil
+}
+
+// Returns the last byte of the source, or zero if it's empty.
+func (sf *SourceFiles) lastByte() (byte, error) {
+	for i := len(sf.paths) - 1; i >= 0; i-- {
+		if sf.sizes[i] == 0 {
+			continue
+		}
+		var b [1]byte
+		if _, err := sf.readAt(i, b[:], sf.sizes[i]-1); err != nil {
+			return 0, fmt.Errorf("read %q: %w", sf.paths[i], err)
+		}
+		return b[0], nil
+	}
+	return 0, nil
+}
+
+// Converts a position to an offset into the concatenation of all files.
+func (sf *SourceFiles) logical(pos StreamPosition) (offset int64) {
+	for i := range pos.file {
+		offset += sf.sizes[i]
+	}
+	return offset + pos.offset
+}
+
+// Reads from the concatenation of all files, without crossing file boundaries.
+func (sf *SourceFiles) readLogical(p []byte, offset int64) (int, error) {
+	pos := sf.position(offset)
+	remaining := sf.sizes[pos.file] - pos.offset
+	if remaining <= 0 {
+		return 0, nil
+	}
+	return sf.readAt(pos.file, p[:min(int64(len(p)), remaining)], pos.offset)
+}
+
+// Returns the offset right after the first line break at or after offset,
+// or the end of the source if there is none. buf is used for reading.
+func (sf *SourceFiles) lineEnd(offset int64, buf []byte) (int64, error) {
+	total := sf.total()
+	for offset < total {
+		n, err := sf.readLogical(buf, offset)
+		if err != nil {
+			return offset, err
+		}
+		if n == 0 {
+			break
+		}
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return offset + int64(i) + 1, nil
+		}
+		offset += int64(n)
+	}
+	return total, nil
+}
+
+// Returns the offset of the first line starting at or after offset.
+func (sf *SourceFiles) nextLineStart(offset int64, buf []byte) (int64, error) {
+	if offset <= 0 {
+		return 0, nil
+	}
+	return sf.lineEnd(offset-1, buf)
+}
+
+// Maximum amount of lines read looking for a timestamp,
+// before giving up on a region of the source.
+const SEEK_TIME_MAX_LINES int = 64
+
+// Returns the timestamp of the first line starting at or after offset
+// that has one, and the offset of that line. Otherwise, returns the offset
+// where the search stopped, after [SEEK_TIME_MAX_LINES] lines or at the end.
+// Lines are read through r, buf is used to find the first one.
+func (sf *SourceFiles) nextLineTime(offset int64, r *bufio.Reader, buf []byte) (t time.Time, line int64, ok bool, err error) {
+	if line, err = sf.nextLineStart(offset, buf); err != nil {
+		return t, line, false, err
+	}
+	r.Reset(&LogicalReader{sf: sf, offset: line})
+	for range SEEK_TIME_MAX_LINES {
+		t, ok, n, err := readLineTime(r)
+		if ok {
+			return t, line, true, nil
+		}
+		line += n
+		if err == io.EOF {
+			return t, line, false, nil
+		}
+		if err != nil {
+			return t, line, false, err
+		}
+	}
+	return t, line, false, nil
+}
+
+// Reads a line from r, returning the timestamp at its start, if any, and its length.
+// Lines longer than the buffer of r only have their start parsed.
+func readLineTime(r *bufio.Reader) (t time.Time, ok bool, n int64, err error) {
+	b, err := r.ReadSlice('\n')
+	t, ok = parseLineTime(bytes.TrimRight(b[:min(len(b), 64)], "\r\n"))
+	n = int64(len(b))
+	for err == bufio.ErrBufferFull {
+		b, err = r.ReadSlice('\n')
+		n += int64(len(b))
+	}
+	return t, ok, n, err
+}
+
+// Finds the offset of the first line timestamped at or after target,
+// assuming timestamps never decrease along the source.
+func (sf *SourceFiles) seekTime(target time.Time) (int64, error) {
+	buf := make([]byte, SEEK_BLOCK_SIZE)
+	r := bufio.NewReaderSize(nil, SEEK_BLOCK_SIZE)
+	lo, hi := int64(0), sf.total()
+	for hi-lo > int64(SEEK_BLOCK_SIZE) {
+		mid := lo + (hi-lo)/2
+		t, line, ok, err := sf.nextLineTime(mid, r, buf)
+		// Lines without a timestamp, such as stack traces, are skipped up to hi.
+		for err == nil && !ok && line < hi {
+			t, line, ok, err = sf.nextLineTime(line, r, buf)
+		}
+		if err != nil {
+			return lo, err
+		}
+		if !ok || !t.Before(target) {
+			hi = mid
+		} else {
+			lo = line + 1
+		}
+	}
+	// Every line starting before lo is older than target.
+	line, err := sf.nextLineStart(lo, buf)
+	if err != nil {
+		return line, err
+	}
+	r.Reset(&LogicalReader{sf: sf, offset: line})
+	for {
+		t, ok, n, err := readLineTime(r)
+		if ok && !t.Before(target) {
+			return line, nil
+		}
+		if err == io.EOF {
+			return sf.total(), nil
+		}
+		if err != nil {
+			return line, err
+		}
+		line += n
+	}
+}
+
+// Reads the concatenation of all files sequentially, starting at offset.
+type LogicalReader struct {
+	sf     *SourceFiles
+	offset int64
+}
+
+func (lr *LogicalReader) Read(p []byte) (int, error) {
+	if lr.offset >= lr.sf.total() {
+		return 0, io.EOF
+	}
+	n, err := lr.sf.readLogical(p, lr.offset)
+	lr.offset += int64(n)
+	if n == 0 && err == nil {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Layouts tried when reading the timestamp at the start of a line,
+// with the amount of space-separated fields they span.
+var lineTimeLayouts = []struct {
+	layout string
+	fields int
+}{
+	{time.RFC3339Nano, 1},
+	{"2006-01-02T15:04:05", 1},
+	{"2006-01-02 15:04:05Z07:00", 2},
+	{"2006-01-02 15:04:05", 2},
+	// The format used by the standard log package, including Logyard's own.
+	{"2006/01/02 15:04:05", 2},
+}
+
+// Parses the timestamp at the start of line, if it has one of the
+// [lineTimeLayouts]. Timestamps without a zone are assumed to be local.
+func parseLineTime(line []byte) (time.Time, bool) {
+	line = bytes.TrimLeft(line, " \t[")
+	// Every layout starts with the year.
+	if len(line) == 0 || line[0] < '0' || line[0] > '9' {
+		return time.Time{}, false
+	}
+	fields := strings.SplitN(string(line), " ", 3)
+	for _, l := range lineTimeLayouts {
+		if len(fields) < l.fields {
+			continue
+		}
+		v := strings.TrimRight(strings.Join(fields[:l.fields], " "), "]")
+		if t, err := time.ParseInLocation(l.layout, v, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns the files of a rolling set with the given contents, oldest first,
+// the last one being the active file. Chunks are gzipped if compress is set.
+func newTestSourceFiles(t *testing.T, compress bool, contents ...string) *SourceFiles {
+	t.Helper()
+	dir := t.TempDir()
+	var chunks []ValidSourceDescriptor
+	for i, c := range contents[:len(contents)-1] {
+		path := filepath.Join(dir, fmt.Sprintf("app-2024-05-01T%02d-00-00.000.log", i))
+		data := []byte(c)
+		if compress {
+			path += COMPRESSED_SUFFIX
+			data = gzipped(data)
+		}
+		if err := os.WriteFile(path, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, ValidSourceDescriptor{path: path, info: compressedInfo{info, int64(len(c))}})
+	}
+	active := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(active, []byte(contents[len(contents)-1]), 0666); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf, err := newSourceFiles(chunks, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sf.Close()
+		f.Close()
+	})
+	return sf
+}
+
+func TestSourceFilesPosition(t *testing.T) {
+	sf := newTestSourceFiles(t, false, "a1\nb1\n", "", "c2\n", "d3\ne3\n")
+	tests := []struct {
+		offset int64
+		want   StreamPosition
+	}{
+		{0, StreamPosition{0, 0}},
+		{5, StreamPosition{0, 5}},
+		// Empty files are skipped.
+		{6, StreamPosition{2, 0}},
+		{8, StreamPosition{2, 2}},
+		{9, StreamPosition{3, 0}},
+		{14, StreamPosition{3, 5}},
+		{15, StreamPosition{3, 6}},
+		{100, StreamPosition{3, 6}},
+	}
+	for _, tt := range tests {
+		got := sf.position(tt.offset)
+		if got != tt.want {
+			t.Errorf("position(%d) = %+v, want %+v", tt.offset, got, tt.want)
+		}
+		if tt.offset <= sf.total() && sf.logical(got) != tt.offset {
+			t.Errorf("logical(%+v) = %d, want %d", got, sf.logical(got), tt.offset)
+		}
+	}
+}
+
+func TestSourceFilesLineStartBefore(t *testing.T) {
+	sf := newTestSourceFiles(t, false, "a1\nb1\n", "c2\n", "d3\ne3")
+	tests := []struct {
+		name string
+		pos  StreamPosition
+		n    int
+		want StreamPosition
+	}{
+		{"within a file", StreamPosition{2, 5}, 1, StreamPosition{2, 3}},
+		{"right after a line break", StreamPosition{2, 3}, 1, StreamPosition{2, 3}},
+		{"at the start of a file", StreamPosition{1, 0}, 1, StreamPosition{0, 6}},
+		{"across files", StreamPosition{2, 5}, 3, StreamPosition{0, 6}},
+		{"past the first line", StreamPosition{2, 5}, 10, StreamPosition{0, 0}},
+		{"no lines", StreamPosition{2, 5}, 0, StreamPosition{2, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sf.lineStartBefore(tt.pos, tt.n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The first position of a file is also the end of the one before it.
+			if sf.logical(got) != sf.logical(tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSourceFilesResolve(t *testing.T) {
+	sources := map[string]*SourceFiles{
+		"plain":      newTestSourceFiles(t, false, "a1\nb1\n", "c2\n", "d3\ne3\n"),
+		"compressed": newTestSourceFiles(t, true, "a1\nb1\n", "c2\n", "d3\ne3\n"),
+	}
+	tests := []struct {
+		name string
+		req  StartRequest
+		// Into the concatenation "a1\nb1\nc2\nd3\ne3\n".
+		want int64
+	}{
+		{"beginning", StartRequest{}, 0},
+		{"end", StartRequest{mode: START_END}, 15},
+		{"no tail", StartRequest{mode: START_TAIL}, 15},
+		{"tail", StartRequest{mode: START_TAIL, tail: 2}, 9},
+		{"tail across files", StartRequest{mode: START_TAIL, tail: 3}, 6},
+		{"tail past the first line", StartRequest{mode: START_TAIL, tail: 10}, 0},
+		{"offset within a line", StartRequest{mode: START_OFFSET, offset: 7}, 6},
+		{"offset at a file boundary", StartRequest{mode: START_OFFSET, offset: 9}, 9},
+		{"offset from the end", StartRequest{mode: START_OFFSET, offset: -1}, 12},
+		{"offset before the start", StartRequest{mode: START_OFFSET, offset: -100}, 0},
+		{"offset past the end", StartRequest{mode: START_OFFSET, offset: 100}, 15},
+	}
+	for name, sf := range sources {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				pos, err := sf.resolve(tt.req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := sf.logical(pos); got != tt.want {
+					t.Errorf("resolved to %d (%+v), want %d", got, pos, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestSourceFilesResolveTime(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	// Large enough to be searched rather than scanned.
+	const lines = 3000
+	var chunks []string
+	// Of every line into the concatenation of chunks.
+	var offsets []int64
+	var b strings.Builder
+	var written int64
+	for i := range lines {
+		offsets = append(offsets, written+int64(b.Len()))
+		fmt.Fprintf(&b, "%s line %d\n", start.Add(time.Duration(i)*time.Second).Format(time.RFC3339), i)
+		if (i+1)%(lines/3) == 0 {
+			chunks = append(chunks, b.String())
+			written += int64(b.Len())
+			b.Reset()
+		}
+	}
+	tests := []struct {
+		name   string
+		target time.Time
+		want   int64
+	}{
+		{"before the first line", start.Add(-time.Hour), 0},
+		{"first line", start, 0},
+		{"in the first chunk", start.Add(500 * time.Second), offsets[500]},
+		{"first line of a chunk", start.Add(1000 * time.Second), offsets[1000]},
+		{"in the middle chunk", start.Add(1500 * time.Second), offsets[1500]},
+		{"between lines", start.Add(1500*time.Second + time.Millisecond), offsets[1501]},
+		{"in the active file", start.Add(2999 * time.Second), offsets[2999]},
+		{"after the last line", start.Add(time.Hour), written},
+	}
+	for _, compress := range []bool{false, true} {
+		sf := newTestSourceFiles(t, compress, chunks...)
+		if sf.total() != written || written <= 2*int64(SEEK_BLOCK_SIZE) {
+			t.Fatalf("source of %d bytes, want %d, more than %d", sf.total(), written, 2*SEEK_BLOCK_SIZE)
+		}
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/compressed=%t", tt.name, compress), func(t *testing.T) {
+				pos, err := sf.resolve(StartRequest{mode: START_TIME, time: tt.target})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := sf.logical(pos); got != tt.want {
+					t.Errorf("resolved to %d (%+v), want %d", got, pos, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestSourceFilesResolveTimeUntimestamped(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	var b strings.Builder
+	// Of every timestamped line.
+	offsets := make(map[int]int64)
+	for i := range 2000 {
+		offsets[i] = int64(b.Len())
+		fmt.Fprintf(&b, "%s line %d\n", start.Add(time.Duration(i)*time.Second).Format(time.RFC3339), i)
+		if i == 999 {
+			// A stack trace far longer than a search step, right in the middle.
+			b.WriteString(strings.Repeat("\tat frame\n", 8*SEEK_BLOCK_SIZE/10))
+		}
+	}
+	sf := newTestSourceFiles(t, false, b.String())
+	for _, i := range []int{0, 500, 999, 1000, 1500, 1999} {
+		pos, err := sf.resolve(StartRequest{mode: START_TIME, time: start.Add(time.Duration(i) * time.Second)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sf.logical(pos); got != offsets[i] {
+			t.Errorf("line %d: resolved to %d, want %d", i, got, offsets[i])
+		}
+	}
+}
+
+func TestParseCursor(t *testing.T) {
+	c := Cursor{file: "a:b.log", offset: 42, crc: 0xdeadbeef}
+	if got, err := parseCursor(c.String()); err != nil || got != c {
+		t.Errorf("parseCursor(%q) = %+v, %v, want %+v", c.String(), got, err, c)
+	}
+	for _, v := range []string{"", "app.log", "app.log:1", ":1:00000000", "app.log:-1:00000000", "app.log:1:xyz", "app.log:1:100000000"} {
+		if c, err := parseCursor(v); err == nil {
+			t.Errorf("parseCursor(%q) = %+v, want an error", v, c)
+		}
+	}
+}
+
+func TestSourceFilesFindCursor(t *testing.T) {
+	sum := func(line string) uint32 { return crc32.ChecksumIEEE([]byte(line)) }
+	// Sent right after "b1\n", while "a1\nb1\n" was all of app.log.
+	sent := Cursor{file: "app.log", offset: 6, crc: sum("b1\n")}
+	tests := []struct {
+		name     string
+		cursor   Cursor
+		compress bool
+		contents []string
+		want     StreamPosition
+		err      error
+	}{
+		{"same file", sent, false, []string{"a1\nb1\nc1\n"}, StreamPosition{0, 6}, nil},
+		{"first line", Cursor{"app.log", 3, sum("a1\n")}, false, []string{"a1\nb1\n"}, StreamPosition{0, 3}, nil},
+		{"start of the file", Cursor{"app.log", 0, 0}, false, []string{"a1\n"}, StreamPosition{0, 0}, nil},
+		{"rotated", sent, false, []string{"a1\nb1\nc1\n", "d2\n"}, StreamPosition{0, 6}, nil},
+		{"rotated and compressed", sent, true, []string{"a1\nb1\nc1\n", "d2\n"}, StreamPosition{0, 6}, nil},
+		{"rotated, active file grown past the offset", sent, false, []string{"a1\nb1\n", "d2\ne2\nf2\n"}, StreamPosition{0, 6}, nil},
+		{"in a compressed chunk", Cursor{"app-2024-05-01T00-00-00.000.log", 3, sum("a1\n")}, true,
+			[]string{"a1\nb1\n", "c2\n"}, StreamPosition{0, 3}, nil},
+		{"line across files", Cursor{"app.log", 2, sum("b1\n")}, false, []string{"a1\nb", "1\nc2\n"}, StreamPosition{1, 2}, nil},
+		{"truncated", sent, false, []string{"a1\n"}, StreamPosition{}, errCursorNotFound},
+		{"rewritten", sent, false, []string{"x1\ny1\n"}, StreamPosition{}, errCursorNotFound},
+		{"chunk removed", Cursor{"app-2024-04-30T00-00-00.000.log", 0, 0}, false, []string{"a1\n", "b2\n"}, StreamPosition{}, errCursorNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sf := newTestSourceFiles(t, tt.compress, tt.contents...)
+			got, err := sf.findCursor(tt.cursor)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
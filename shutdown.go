@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Asks the running command to stop gracefully, sending sig on [Globals.shutdown].
+// sig is zero for requests that don't come from a signal.
+//
+// Returns false if a shutdown was already requested, in which case nothing is sent.
+func (g *Globals) requestShutdown(sig syscall.Signal) bool {
+	if !g.stopping.CompareAndSwap(false, true) {
+		return false
+	}
+	g.shutdown <- sig
+	return true
+}
+
+// Returns a context that expires [BaseConfig.shutdownTimeout] milliseconds from now,
+// or never for non-positive timeouts.
+func (g *Globals) shutdownContext() (context.Context, context.CancelFunc) {
+	if g.shutdownTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), time.Duration(g.shutdownTimeout)*time.Millisecond)
+}
+
+// Requests a shutdown on SIGINT or SIGTERM.
+// A second signal exits right away, without waiting for the command to stop.
+func handleSignals(g *Globals) {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	for sig := range c {
+		n, _ := sig.(syscall.Signal)
+		if g.requestShutdown(n) {
+			log.Printf("%s received, shutting down. Signal again to exit right away.", sig)
+			continue
+		}
+		log.Printf("%s received again, exiting.", sig)
+		if f := g.forceExit.Load(); f != nil {
+			(*f)()
+		}
+		g.logCapture.Close()
+		os.Exit(128 + int(n))
+	}
+}
+
+// Waits for a shutdown request, then stops accepting connections
+// and closes every stream. Streams write whatever they already queued
+// before sending a close frame, for at most [BaseConfig.shutdownTimeout].
+func stopServer(sr *ServerResources) error {
+	<-sr.g.shutdown
+	sr.log.Print("Shutting down...")
+	ctx, cancel := sr.g.shutdownContext()
+	defer cancel()
+	err := sr.s.Shutdown(ctx)
+	// Push handlers may outlive a Shutdown that timed out.
+	if cerr := sr.closePush(ctx); cerr != nil {
+		sr.log.Printf("Failed to close pushed capture files: %+v", cerr)
+	}
+	if n := sr.closeStreams(errShutdown); n > 0 {
+		sr.log.Printf("Closing %d streams.", n)
+	}
+	done := make(chan struct{})
+	go func() {
+		sr.streamsWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return fmt.Errorf("streams still open after %dms: %w", sr.g.shutdownTimeout, ctx.Err())
+	}
+	if err != nil {
+		return fmt.Errorf("shutdown server: %w", err)
+	}
+	return nil
+}
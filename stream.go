@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Returned while streaming when a control message requires
+// the stream to start over from [Stream.restart].
+var errRestart = errors.New("stream restart requested")
+
+// Why a stream was stopped by the server, see [ServerResources.stopStreams].
+var (
+	errSourceRemoved = errors.New("source no longer served")
+	errShutdown      = errors.New("server shutting down")
+)
+
+// Options for a stream, from the query parameters of its endpoint.
+type StreamOptions struct {
+	start    StartRequest
+	envelope Envelope
+	// Applied from the first line, see [parseFilterQuery].
+	filter *LineFilter
+}
+
+func parseStreamOptions(q url.Values) (opts StreamOptions, err error) {
+	if opts.start, err = parseStartRequest(q); err != nil {
+		return opts, err
+	}
+	if opts.envelope, err = parseEnvelope(q.Get("envelope")); err != nil {
+		return opts, err
+	}
+	if opts.filter, err = parseFilterQuery(q); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// The state of a single WebSocket stream.
+type Stream struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	tag    string
+	sr     *ServerResources
+	vsd    *ValidSourceDescriptor
+	conn   *websocket.Conn
+	// Writes every message sent to the client.
+	w *StreamWriter
+	// The currently open file. Replaced when the source is rotated.
+	f *os.File
+	// Stat of f taken when it was opened, used to detect rotations.
+	info os.FileInfo
+	r    *bufio.Reader
+	// Bytes consumed from f, including [partial].
+	offset int64
+	// An incomplete trailing line, waiting for its line break.
+	partial []byte
+	// Whether the source path was missing on the last check.
+	missing bool
+	// Offset of f within the logical source, that is, the size of
+	// the rotated chunks that precede it.
+	base int64
+	// Offset within the logical source right after the last complete
+	// line read, whether it was sent or filtered out.
+	sent int64
+	// Number of the last line read, or zero if unknown.
+	lineNo   int64
+	envelope Envelope
+	// Name of the file lines are currently read from,
+	// either the active file or a rotated chunk.
+	file string
+	// Messages received from the client, in order.
+	controls chan ControlMessage
+	// Set by the client through [CONTROL_FILTER] messages.
+	filter *LineFilter
+	// Whether the client paused the stream.
+	paused bool
+	// Where to start over after [errRestart],
+	// and the control message that requested it.
+	restart    StartRequest
+	restartCmd ControlMessage
+	// Rotated chunks left to send before the active file,
+	// and the offset to start reading the first one.
+	pending       []ValidSourceDescriptor
+	pendingOffset int64
+	// The first of them, if compressed and already inflated while seeking.
+	pendingInflated *InflatedChunk
+}
+
+// Streams the file at vsd line by line, following it as it grows
+// until the connection fails.
+//
+// If vsd is the active file of a rolling set, its rotated chunks
+// are streamed first, oldest to newest.
+// Streaming starts at the position requested by opts, and may be
+// paused, resumed or moved by the client with [ControlMessage]s.
+//
+// Rotations (the path now names a different file) and truncations
+// (the file shrank below what was already read) are detected,
+// and reported to the client with a marker frame.
+func streamLogFile(tag string, sr *ServerResources, vsd *ValidSourceDescriptor, conn *websocket.Conn, opts StreamOptions) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	s := &Stream{
+		ctx:      ctx,
+		cancel:   cancel,
+		tag:      tag,
+		sr:       sr,
+		vsd:      vsd,
+		conn:     conn,
+		controls: make(chan ControlMessage, 16),
+		envelope: opts.envelope,
+		filter:   opts.filter,
+	}
+	defer conn.Close()
+	s.w = newStreamWriter(ctx, cancel, tag, sr, conn, opts.envelope)
+	if !sr.addStream(s) {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, errShutdown.Error()), time.Now().Add(time.Second))
+		return
+	}
+	defer sr.removeStream(s)
+	go func() {
+		s.readControls()
+		cancel(nil)
+	}()
+	// Subscribe before the first read, so no change goes unnoticed.
+	fw := newFollower(sr, vsd.path)
+	defer fw.Close()
+	defer func() {
+		if s.f != nil {
+			s.f.Close()
+		}
+		s.clearPending()
+	}()
+	s.restart = opts.start
+	for {
+		err := s.follow(fw)
+		if !errors.Is(err, errRestart) {
+			sr.log.Printf("%s %+v", tag, err)
+			s.close(err)
+			return
+		}
+		sr.log.Printf("%s Restarting stream for %q.", tag, s.restartCmd.Type)
+	}
+}
+
+// Stops the writer after the stream ended with err, closing the
+// connection with a close frame if the server is the one ending it.
+func (s *Stream) close(err error) {
+	cause := context.Cause(s.ctx)
+	switch {
+	case errors.Is(err, errSlowClient):
+		s.w.Abort(websocket.ClosePolicyViolation, err.Error())
+	case errors.Is(cause, errSourceRemoved), errors.Is(cause, errShutdown):
+		s.w.Shutdown(websocket.CloseGoingAway, cause.Error())
+	default:
+		s.w.Close()
+	}
+}
+
+// Registers a running stream. Returns false if the server
+// is shutting down, in which case the stream must not start.
+func (sr *ServerResources) addStream(s *Stream) bool {
+	sr.streamsMu.Lock()
+	defer sr.streamsMu.Unlock()
+	if sr.streamsClosed {
+		return false
+	}
+	if sr.streams == nil {
+		sr.streams = make(map[*Stream]struct{})
+	}
+	sr.streams[s] = struct{}{}
+	sr.streamsWg.Add(1)
+	return true
+}
+
+func (sr *ServerResources) removeStream(s *Stream) {
+	sr.streamsMu.Lock()
+	defer sr.streamsMu.Unlock()
+	delete(sr.streams, s)
+	sr.streamsWg.Done()
+}
+
+// Stops the running streams selected by stop, with cause as the reason.
+// Returns the number of streams stopped.
+func (sr *ServerResources) stopStreams(stop func(*Stream) bool, cause error) (n int) {
+	sr.streamsMu.Lock()
+	defer sr.streamsMu.Unlock()
+	return sr.stopStreamsLocked(stop, cause)
+}
+
+// Stops every stream and prevents new ones from starting.
+// [ServerResources.streamsWg] may be waited on afterwards.
+func (sr *ServerResources) closeStreams(cause error) (n int) {
+	sr.streamsMu.Lock()
+	defer sr.streamsMu.Unlock()
+	sr.streamsClosed = true
+	return sr.stopStreamsLocked(func(*Stream) bool { return true }, cause)
+}
+
+func (sr *ServerResources) stopStreamsLocked(stop func(*Stream) bool, cause error) (n int) {
+	for s := range sr.streams {
+		if stop(s) {
+			s.cancel(cause)
+			n++
+		}
+	}
+	return n
+}
+
+// Starts at [Stream.restart] and follows the source until an error occurs.
+func (s *Stream) follow(fw Follower) error {
+	cmd := s.restartCmd
+	s.restartCmd = ControlMessage{}
+	size, err := s.start(s.restart)
+	if err != nil {
+		if cmd.Type != "" {
+			s.sendFrame(errorFrame(cmd, err))
+		}
+		return err
+	}
+	switch cmd.Type {
+	case CONTROL_SEEK:
+		if err := s.sendFrame(ackFrame(cmd, s.sent)); err != nil {
+			return err
+		}
+	case CONTROL_RESYNC:
+		frame := ackFrame(cmd, s.sent)
+		frame.Size = &size
+		if err := s.sendFrame(frame); err != nil {
+			return err
+		}
+	}
+	if err := s.sendPending(); err != nil {
+		return err
+	}
+	for {
+		if !s.paused {
+			if err := s.readAvailable(); err != nil {
+				return err
+			}
+			if err := s.check(); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-fw.Changed():
+		case m := <-s.controls:
+			if err := s.handleControl(m); err != nil {
+				return err
+			}
+		case <-s.ctx.Done():
+			return fmt.Errorf("stream ended: %w", s.ctx.Err())
+		}
+	}
+}
+
+// (Re)opens the source and moves to the position requested by req.
+// Rotated chunks to send before the active file are left in [Stream.pending].
+//
+// Returns the size of the whole source.
+func (s *Stream) start(req StartRequest) (size int64, err error) {
+	if s.f != nil {
+		s.f.Close()
+		s.f = nil
+	}
+	s.partial = nil
+	s.clearPending()
+	if err := s.open(); err != nil {
+		return 0, fmt.Errorf("file error: %w", err)
+	}
+	// Listed after opening the active file: a rotation past this point
+	// is handled by [Stream.check], and one before it shows up here.
+	chunks, err := findChunks(s.vsd.path)
+	if err != nil {
+		s.sr.log.Printf("%s Chunks error: %+v", s.tag, err)
+	}
+	chunks = slices.DeleteFunc(chunks, func(c ValidSourceDescriptor) bool {
+		return os.SameFile(c.info, s.info)
+	})
+	sf, err := newSourceFiles(chunks, s.f)
+	if err != nil {
+		return 0, fmt.Errorf("file error: %w", err)
+	}
+	defer sf.Close()
+	pos, err := sf.resolve(req)
+	resumeFailed := errors.Is(err, errCursorNotFound)
+	if resumeFailed {
+		// Most likely truncated, or the cursor's chunk was removed.
+		pos = StreamPosition{file: len(chunks)}
+	} else if err != nil {
+		return 0, fmt.Errorf("seek error: %w", err)
+	}
+	s.sent = sf.logical(pos)
+	s.base = sf.logical(StreamPosition{file: len(chunks)})
+	// Counting lines is only possible from the very beginning.
+	s.lineNo = 0
+	if pos.file < len(chunks) {
+		s.pending = chunks[pos.file:]
+		s.pendingOffset = pos.offset
+		s.pendingInflated = sf.takeInflated(pos.file)
+	} else if pos.offset > 0 {
+		if _, err := s.f.Seek(pos.offset, io.SeekStart); err != nil {
+			return 0, fmt.Errorf("seek error: %w", err)
+		}
+		s.r.Reset(s.f)
+		s.offset = pos.offset
+	}
+	if resumeFailed {
+		s.sr.log.Printf("%s Resume cursor %q not found, resuming from the active file.", s.tag, req.cursor)
+		err := s.sendMarker(MARKER_RESUME_FAILED, "could not resume where the stream left, some lines may be missing or repeated")
+		if err != nil {
+			return 0, err
+		}
+	}
+	return sf.total(), nil
+}
+
+// Sends the [Stream.pending] chunks.
+func (s *Stream) sendPending() error {
+	for len(s.pending) > 0 {
+		c := s.pending[0]
+		offset, inflated := s.pendingOffset, s.pendingInflated
+		s.pending = s.pending[1:]
+		s.pendingOffset, s.pendingInflated = 0, nil
+		if err := s.streamChunk(c.path, offset, inflated); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Stream) clearPending() {
+	s.pending = nil
+	if s.pendingInflated != nil {
+		s.pendingInflated.Close()
+		s.pendingInflated = nil
+	}
+}
+
+func (s *Stream) open() error {
+	f, err := os.Open(s.vsd.path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f = f
+	s.info = info
+	s.r = bufio.NewReaderSize(f, READ_BUFFER_SIZE)
+	s.offset = 0
+	s.file = filepath.Base(s.vsd.path)
+	return nil
+}
+
+// Compares the source path against the open file, reopening it
+// if it was rotated and rewinding it if it was truncated.
+func (s *Stream) check() error {
+	info, err := os.Stat(s.vsd.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Likely mid-rotation, keep reading the old file until the path is back.
+		if !s.missing {
+			s.missing = true
+			s.sr.log.Printf("%s Source missing, waiting for it to reappear.", s.tag)
+			return s.sendMarker(MARKER_MISSING, "source file removed, waiting for it to reappear")
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("stat error: %w", err)
+	}
+	s.missing = false
+	if !os.SameFile(s.info, info) {
+		// Whatever was written to the old file before the swap belongs first.
+		// A trailing partial line is continued by the new file, since
+		// rotating writers may split a single write across both.
+		if err := s.readAvailable(); err != nil {
+			return err
+		}
+		s.f.Close()
+		s.base += s.offset
+		if err := s.open(); err != nil {
+			return fmt.Errorf("reopen error: %w", err)
+		}
+		s.sr.log.Printf("%s Source rotated, reopened.", s.tag)
+		return s.sendMarker(MARKER_ROTATED, "source file rotated, following the new file")
+	}
+	if info.Size() < s.offset {
+		if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("seek error: %w", err)
+		}
+		s.r.Reset(s.f)
+		s.offset = 0
+		s.partial = nil
+		s.sent = s.base
+		s.lineNo = 0
+		s.sr.log.Printf("%s Source truncated, rewound.", s.tag)
+		return s.sendMarker(MARKER_TRUNCATED, "source file truncated, reading from the start")
+	}
+	return nil
+}
+
+// Sends every complete line available in the open file.
+func (s *Stream) readAvailable() error {
+	for {
+		line, err := s.r.ReadBytes('\n')
+		s.offset += int64(len(line))
+		if err == io.EOF {
+			if len(line) != 0 {
+				s.partial = append(s.partial, line...)
+			}
+			return nil
+		}
+		if err != nil {
+			s.flushPartial()
+			return fmt.Errorf("reader error: %w", err)
+		}
+		if s.partial != nil {
+			line = bytes.Join([][]byte{s.partial, line}, nil)
+			s.partial = nil
+		}
+		if err := s.sendLine(line, s.offset); err != nil {
+			return err
+		}
+	}
+}
+
+// Sends the content of a rotated chunk from offset,
+// the chunk itself is not expected to change.
+// inflated is its decompressed copy, if already made, closed once sent.
+//
+// A trailing partial line is kept in [Stream.partial],
+// to be completed by the next chunk or the active file.
+func (s *Stream) streamChunk(path string, offset int64, inflated *InflatedChunk) error {
+	var f io.ReadCloser
+	var err error
+	switch {
+	case inflated != nil:
+		f = inflated
+	case offset > 0 && isCompressedChunk(path):
+		// Gzip doesn't allow seeking.
+		f, err = inflateChunk(path)
+	default:
+		f, err = openChunk(path)
+	}
+	if err != nil {
+		// Rotated chunks may be removed by retention at any time.
+		s.sr.log.Printf("%s Skipping chunk %q: %+v", s.tag, path, err)
+		return nil
+	}
+	defer f.Close()
+	if offset > 0 {
+		if _, err := f.(io.Seeker).Seek(offset, io.SeekStart); err != nil {
+			return fmt.Errorf("chunk seek error: %w", err)
+		}
+	}
+	s.file = uncompressedName(path)
+	defer func() { s.file = filepath.Base(s.vsd.path) }()
+	r := bufio.NewReaderSize(f, READ_BUFFER_SIZE)
+	for {
+		line, err := r.ReadBytes('\n')
+		offset += int64(len(line))
+		if err == io.EOF {
+			s.partial = append(s.partial, line...)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("chunk reader error: %w", err)
+		}
+		if s.partial != nil {
+			line = bytes.Join([][]byte{s.partial, line}, nil)
+			s.partial = nil
+		}
+		if err := s.sendLine(line, offset); err != nil {
+			return err
+		}
+	}
+}
+
+// Sends [Stream.partial] as a line of its own, if any.
+func (s *Stream) flushPartial() error {
+	if len(s.partial) == 0 {
+		return nil
+	}
+	last := s.partial
+	s.partial = nil
+	return s.sendLine(last, s.offset)
+}
+
+// Sends a line to the client, unless filtered out.
+// end is the offset right after the line within [Stream.file].
+//
+// Pending control messages are handled first,
+// blocking for as long as the stream is paused.
+func (s *Stream) sendLine(line []byte, end int64) error {
+	if err := s.pollControls(); err != nil {
+		return err
+	}
+	offset := s.sent
+	s.sent += int64(len(line))
+	if offset == 0 || s.lineNo > 0 {
+		s.lineNo++
+	}
+	if !s.filter.Match(line) {
+		return nil
+	}
+	cursor := Cursor{file: s.file, offset: end, crc: crc32.ChecksumIEEE(line)}
+	t, msg, err := s.encodeLine(line, offset, cursor)
+	if err != nil {
+		return err
+	}
+	return s.w.writeLine(t, msg)
+}
+
+func (s *Stream) pollControls() error {
+	for {
+		var m ControlMessage
+		if s.paused {
+			select {
+			case m = <-s.controls:
+			case <-s.ctx.Done():
+				return fmt.Errorf("stream ended: %w", s.ctx.Err())
+			}
+		} else {
+			select {
+			case m = <-s.controls:
+			default:
+				return nil
+			}
+		}
+		if err := s.handleControl(m); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Stream) sendMarker(event string, msg string) error {
+	offset := s.sent
+	return s.sendFrame(ControlFrame{
+		Type:    FRAME_MARKER,
+		Event:   event,
+		Message: msg,
+		Offset:  &offset,
+	})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// When a supervised command is started again after exiting, see [SuperviseConfig.restart].
+const (
+	RESTART_NEVER      string = "never"
+	RESTART_ON_FAILURE string = "on-failure"
+	RESTART_ALWAYS     string = "always"
+)
+
+func validateRestartPolicy(policy string) error {
+	switch policy {
+	case RESTART_NEVER, RESTART_ON_FAILURE, RESTART_ALWAYS:
+		return nil
+	}
+	return fmt.Errorf("unknown restart policy %q: must be %q, %q or %q",
+		policy, RESTART_NEVER, RESTART_ON_FAILURE, RESTART_ALWAYS)
+}
+
+// Tags of the lines of a supervised command, in a capture file shared by both its streams.
+// Starts, exits and restarts are tagged [TAG_EVENT] in every capture file.
+const (
+	TAG_STDOUT string = "stdout"
+	TAG_STDERR string = "stderr"
+	TAG_EVENT  string = "logyard"
+)
+
+// Runs the command in [BaseConfig.args] and captures its output.
+type Supervisor struct {
+	g *Globals
+	// A single capture file, or one per stream with [SuperviseConfig.split].
+	files  []*CaptureWriter
+	stdout io.Writer
+	stderr io.Writer
+	// Record events, one per capture file.
+	events []io.Writer
+	// Set once a shutdown is requested, after which the command is never restarted.
+	stopping bool
+}
+
+// Runs the command, restarting it according to [SuperviseConfig.restart],
+// until it exits for good or a shutdown is requested.
+//
+// Shutdown requests are forwarded to the command, which is killed if it
+// doesn't exit within [BaseConfig.shutdownTimeout]. See [forwardedSignals]
+// for other signals forwarded to it.
+func startSupervisor(g *Globals) (err error) {
+	if len(g.args) == 0 {
+		return fmt.Errorf("no command to run, see \"logyard %s %s\"", COMMAND_HELP, COMMAND_RUN)
+	}
+	log.Printf("Starting run mode. Command: %q. Capture id: %q. Capture path: %q", g.args, g.captureId, g.capturePath)
+	sv := &Supervisor{g: g}
+	defer func() {
+		if cerr := sv.close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	if err := sv.open(); err != nil {
+		return err
+	}
+	forward := make(chan os.Signal, 1)
+	if len(forwardedSignals) > 0 {
+		signal.Notify(forward, forwardedSignals...)
+		defer signal.Stop(forward)
+	}
+	return sv.loop(forward)
+}
+
+func (sv *Supervisor) open() error {
+	cfg := &sv.g.CaptureConfig
+	if !sv.g.split {
+		cw, err := openCapture(sv.g, sv.g.captureId, sv.g.captureId, os.O_TRUNC)
+		if err != nil {
+			return err
+		}
+		seq := new(atomic.Uint64)
+		sv.files = []*CaptureWriter{cw}
+		sv.stdout = newLinePrefixer(cw, cfg, seq, TAG_STDOUT)
+		sv.stderr = newLinePrefixer(cw, cfg, seq, TAG_STDERR)
+		sv.events = []io.Writer{newLinePrefixer(cw, cfg, seq, TAG_EVENT)}
+		return nil
+	}
+	var err error
+	if sv.stdout, err = sv.openStream(TAG_STDOUT); err != nil {
+		return err
+	}
+	sv.stderr, err = sv.openStream(TAG_STDERR)
+	return err
+}
+
+// Opens the capture file of a single stream, with [SuperviseConfig.split].
+func (sv *Supervisor) openStream(name string) (io.Writer, error) {
+	cw, err := openCapture(sv.g, sv.g.captureId, sv.g.captureId+"-"+name, os.O_TRUNC)
+	if err != nil {
+		return nil, err
+	}
+	seq := new(atomic.Uint64)
+	sv.files = append(sv.files, cw)
+	sv.events = append(sv.events, newLinePrefixer(cw, &sv.g.CaptureConfig, seq, TAG_EVENT))
+	return newLinePrefixer(cw, &sv.g.CaptureConfig, seq, ""), nil
+}
+
+func (sv *Supervisor) close() (err error) {
+	for _, cw := range sv.files {
+		if cerr := cw.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("close capture file: %w", cerr)
+		}
+	}
+	return err
+}
+
+// Logs an event and records it in every capture file.
+func (sv *Supervisor) event(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	log.Print(msg)
+	for _, w := range sv.events {
+		if _, err := w.Write([]byte(msg + "\n")); err != nil {
+			log.Printf("Failed to record event: %+v", err)
+		}
+	}
+}
+
+func (sv *Supervisor) loop(forward <-chan os.Signal) error {
+	for restarts := 0; ; restarts++ {
+		state, err := sv.runOnce(forward)
+		if err != nil {
+			sv.event("Failed to start %q: %v", sv.g.args, err)
+		}
+		if sv.stopping {
+			return nil
+		}
+		failed := err != nil || !state.Success()
+		if sv.g.restart == RESTART_NEVER || sv.g.restart == RESTART_ON_FAILURE && !failed {
+			return exitError(state, err)
+		}
+		if sv.g.maxRestarts > 0 && restarts >= sv.g.maxRestarts {
+			sv.event("Giving up after %d restarts.", restarts)
+			return exitError(state, err)
+		}
+		sv.event("Restarting in %dms (restart %d).", sv.g.restartDelay, restarts+1)
+		select {
+		case <-time.After(time.Duration(sv.g.restartDelay) * time.Millisecond):
+		case <-sv.g.shutdown:
+			sv.event("Shutdown requested, not restarting.")
+			return nil
+		}
+	}
+}
+
+// Describes how a command ended, if it didn't end well.
+func exitError(state *os.ProcessState, err error) error {
+	if err != nil {
+		return fmt.Errorf("start command: %w", err)
+	}
+	if !state.Success() {
+		return fmt.Errorf("command %s", describeExit(state))
+	}
+	return nil
+}
+
+func describeExit(state *os.ProcessState) string {
+	if code := state.ExitCode(); code >= 0 {
+		return fmt.Sprintf("exited with code %d", code)
+	}
+	return "ended by " + state.String()
+}
+
+// Starts the command and waits for it to exit, capturing its output.
+// Returns an error only if the command could not be started.
+func (sv *Supervisor) runOnce(forward <-chan os.Signal) (*os.ProcessState, error) {
+	cmd := exec.Command(sv.g.args[0], sv.g.args[1:]...)
+	configureCommand(cmd)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	started := time.Now()
+	sv.event("Started %q, pid %d.", sv.g.args, cmd.Process.Pid)
+	forceExit := func() { killCommand(cmd) }
+	sv.g.forceExit.Store(&forceExit)
+	defer sv.g.forceExit.Store(nil)
+
+	var pumps sync.WaitGroup
+	pumps.Add(2)
+	go pump(&pumps, stdout, sv.stdout)
+	go pump(&pumps, stderr, sv.stderr)
+	waited := make(chan error, 1)
+	go func() {
+		// Pipes must be read to the end before waiting.
+		pumps.Wait()
+		waited <- cmd.Wait()
+	}()
+
+	// Nil until the command is asked to stop.
+	var kill <-chan struct{}
+	// Releases the timer behind kill, once it fires or the command exits.
+	cancel := func() {}
+	for {
+		select {
+		case sig := <-sv.g.shutdown:
+			sv.stopping = true
+			sv.stop(cmd, sig)
+			cancel()
+			var ctx context.Context
+			ctx, cancel = sv.g.shutdownContext()
+			kill = ctx.Done()
+		case sig := <-forward:
+			log.Printf("Forwarding %s to pid %d.", sig, cmd.Process.Pid)
+			if err := cmd.Process.Signal(sig); err != nil {
+				log.Printf("Failed to forward %s: %+v", sig, err)
+			}
+		case <-kill:
+			kill = nil
+			cancel()
+			sv.event("Still running after %dms, killing pid %d.", sv.g.shutdownTimeout, cmd.Process.Pid)
+			if err := killCommand(cmd); err != nil {
+				log.Printf("Failed to kill pid %d: %+v", cmd.Process.Pid, err)
+			}
+		case err := <-waited:
+			cancel()
+			var exit *exec.ExitError
+			if err != nil && !errors.As(err, &exit) {
+				log.Printf("Wait error: %+v", err)
+			}
+			sv.event("Pid %d %s after %s.", cmd.Process.Pid, describeExit(cmd.ProcessState),
+				time.Since(started).Round(time.Millisecond))
+			return cmd.ProcessState, nil
+		}
+	}
+}
+
+// Forwards the signal that requested a shutdown, or SIGTERM if none did.
+// The command is killed right away if signals can't be delivered.
+func (sv *Supervisor) stop(cmd *exec.Cmd, sig syscall.Signal) {
+	if sig == 0 {
+		sig = syscall.SIGTERM
+	}
+	sv.event("Shutdown requested, sending %s to pid %d.", sig, cmd.Process.Pid)
+	if err := cmd.Process.Signal(sig); err != nil {
+		log.Printf("Failed to signal pid %d, killing it: %+v", cmd.Process.Pid, err)
+		killCommand(cmd)
+	}
+}
+
+// Copies the output of a command into w, so that its streams
+// sharing a capture file don't interleave within lines.
+func pump(wg *sync.WaitGroup, r io.Reader, w io.Writer) {
+	defer wg.Done()
+	br := bufio.NewReaderSize(r, LINE_BUFFER_SIZE)
+	err := copyLines(br, w)
+	var werr *WriteError
+	if errors.As(err, &werr) {
+		log.Printf("Capture error, discarding output: %+v", err)
+		// The command would block on a full pipe otherwise.
+		io.Copy(io.Discard, br)
+	} else if err != nil {
+		log.Printf("Read error: %+v", err)
+	}
+}
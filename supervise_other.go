@@ -0,0 +1,18 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Signals forwarded to a supervised command as they are received.
+// SIGINT and SIGTERM are forwarded as shutdown requests instead.
+var forwardedSignals []os.Signal
+
+func configureCommand(cmd *exec.Cmd) {}
+
+func killCommand(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
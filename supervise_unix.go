@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Signals forwarded to a supervised command as they are received.
+// SIGINT and SIGTERM are forwarded as shutdown requests instead.
+var forwardedSignals = []os.Signal{syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2}
+
+// Runs cmd in a process group of its own, so that signals sent by the terminal
+// reach it only once, through Logyard. The command gets no standard input,
+// since background process groups can't read from the terminal.
+func configureCommand(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Kills cmd along with the rest of its process group.
+func killCommand(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
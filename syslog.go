@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// How syslog messages are split into capture files, see [IngestConfig.syslogPartition].
+const (
+	PARTITION_HOST     string = "host"
+	PARTITION_APP      string = "app"
+	PARTITION_HOST_APP string = "host-app"
+)
+
+func validateSyslogPartition(partition string) error {
+	switch partition {
+	case PARTITION_HOST, PARTITION_APP, PARTITION_HOST_APP:
+		return nil
+	}
+	return fmt.Errorf("unknown syslog partition %q: must be %q, %q or %q",
+		partition, PARTITION_HOST, PARTITION_APP, PARTITION_HOST_APP)
+}
+
+func validateSyslogListen(v string) error {
+	_, err := parseListenAddresses(v, false, "udp", "tcp")
+	return err
+}
+
+// Max size of a syslog message. Longer messages are truncated over UDP
+// and newline-delimited TCP, and close octet-counted TCP connections.
+const MAX_SYSLOG_MESSAGE_SIZE int = 64 << 10
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// A message parsed from either RFC 3164 or RFC 5424.
+// Fields missing from the message are empty.
+type SyslogMessage struct {
+	facility int
+	severity int
+	time     time.Time
+	host     string
+	app      string
+	procId   string
+	msgId    string
+	// RFC 5424 structured data, as received.
+	data string
+	msg  string
+}
+
+// Parses a syslog message in either format, guessing whichever fits.
+// Messages without a priority are assumed to be "user.notice", as per RFC 3164.
+// Parts that can't be parsed end up in the message itself, received is
+// used when the message has no timestamp, and from when it has no host.
+func parseSyslog(b []byte, received time.Time, from string) SyslogMessage {
+	b = bytes.TrimRight(b, "\r\n\x00")
+	m := SyslogMessage{facility: 1, severity: 5, time: received, host: from}
+	rest, ok := m.parsePriority(b)
+	if !ok {
+		m.msg = string(b)
+		return m
+	}
+	if v, ok := bytes.CutPrefix(rest, []byte("1 ")); ok {
+		m.parseRFC5424(v)
+	} else {
+		m.parseRFC3164(rest, received)
+	}
+	return m
+}
+
+// Parses the leading "<PRI>", returning what follows it.
+func (m *SyslogMessage) parsePriority(b []byte) ([]byte, bool) {
+	if len(b) < 3 || b[0] != '<' {
+		return b, false
+	}
+	end := bytes.IndexByte(b[:min(len(b), 5)], '>')
+	if end < 2 {
+		return b, false
+	}
+	pri, err := strconv.Atoi(string(b[1:end]))
+	if err != nil || pri < 0 || pri >= len(syslogFacilities)*8 {
+		return b, false
+	}
+	m.facility, m.severity = pri/8, pri%8
+	return b[end+1:], true
+}
+
+// Parses "TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]".
+func (m *SyslogMessage) parseRFC5424(b []byte) {
+	fields := make([]string, 5)
+	for i := range fields {
+		field, rest, _ := bytes.Cut(b, []byte(" "))
+		fields[i], b = string(field), rest
+	}
+	if t, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+		m.time = t
+	}
+	for i, v := range []*string{&m.host, &m.app, &m.procId, &m.msgId} {
+		if fields[i+1] != "-" && fields[i+1] != "" {
+			*v = fields[i+1]
+		}
+	}
+	data, rest := cutStructuredData(b)
+	if data != "-" {
+		m.data = data
+	}
+	rest = bytes.TrimPrefix(rest, []byte(" "))
+	m.msg = string(bytes.TrimPrefix(rest, []byte("\ufeff")))
+}
+
+// Splits RFC 5424 structured data, "-" or a sequence of "[...]" elements,
+// from whatever follows it. Values may contain escaped brackets.
+func cutStructuredData(b []byte) (string, []byte) {
+	if len(b) == 0 || b[0] != '[' {
+		field, rest, _ := bytes.Cut(b, []byte(" "))
+		return string(field), rest
+	}
+	i, quoted := 0, false
+	for i < len(b) {
+		switch c := b[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == ']' && !quoted && (i+1 == len(b) || b[i+1] != '['):
+			return string(b[:i+1]), b[i+1:]
+		}
+		i++
+	}
+	return string(b), nil
+}
+
+// Parses "TIMESTAMP HOSTNAME TAG: MSG", where the timestamp is usually
+// "Mmm dd hh:mm:ss", in local time and without a year.
+// Parts are skipped when they don't look like what they should be.
+func (m *SyslogMessage) parseRFC3164(b []byte, received time.Time) {
+	if len(b) >= len(time.Stamp) {
+		stamp, year := string(b[:len(time.Stamp)]), received.In(time.Local).Year()
+		// Around new year, the message may come from the previous one, or from
+		// the next if the sender is ahead. The latest year not in the future wins,
+		// leaving some slack for clocks and time zones that don't match.
+		for _, y := range []int{year + 1, year, year - 1} {
+			t, err := time.ParseInLocation("2006 "+time.Stamp, strconv.Itoa(y)+" "+stamp, time.Local)
+			if err == nil && !t.After(received.Add(24*time.Hour)) {
+				m.time = t
+				b = bytes.TrimPrefix(b[len(time.Stamp):], []byte(" "))
+				break
+			}
+		}
+	}
+	if field, rest, ok := bytes.Cut(b, []byte(" ")); ok && m.time.Equal(received) {
+		// Some senders use RFC 3339 timestamps instead.
+		if t, err := time.Parse(time.RFC3339Nano, string(field)); err == nil {
+			m.time = t
+			b = rest
+		}
+	}
+	if field, rest, ok := bytes.Cut(b, []byte(" ")); ok && !isSyslogTag(field) {
+		m.host = string(field)
+		b = rest
+	}
+	if field, rest, ok := bytes.Cut(b, []byte(" ")); ok && isSyslogTag(field) {
+		tag := strings.TrimSuffix(string(field), ":")
+		if app, pid, ok := strings.Cut(tag, "["); ok {
+			tag, m.procId = app, strings.TrimSuffix(pid, "]")
+		}
+		m.app = tag
+		b = rest
+	}
+	m.msg = string(b)
+}
+
+// Whether field looks like an RFC 3164 tag, "app:" or "app[pid]:".
+func isSyslogTag(field []byte) bool {
+	return bytes.HasSuffix(field, []byte(":")) && len(field) > 1 && len(field) <= 48 ||
+		bytes.HasSuffix(field, []byte("]:")) && bytes.IndexByte(field, '[') > 0
+}
+
+// Returns the capture id of m, as set by partition.
+// Missing parts are replaced with "unknown".
+func (m *SyslogMessage) captureId(partition string) string {
+	host, app := sanitizeCaptureId(m.host), sanitizeCaptureId(m.app)
+	switch partition {
+	case PARTITION_HOST:
+		return host
+	case PARTITION_APP:
+		return app
+	}
+	return sanitizeCaptureId(host + "-" + app)
+}
+
+// Turns v into a valid capture id, replacing any unsafe character with "_".
+func sanitizeCaptureId(v string) string {
+	if v == "" {
+		return "unknown"
+	}
+	b := []byte(v)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			b[i] = '_'
+		}
+	}
+	if b[0] == '.' || b[0] == '-' {
+		b[0] = '_'
+	}
+	return string(b[:min(len(b), 128)])
+}
+
+// Formats m as a single line:
+//
+//	<time> <facility>.<severity> <host> <app>[<procid>] <msgid> [<data>]: <msg>
+//
+// The time is in UTC, first so that streams can seek by time. The selector
+// follows the syslog convention, so that lines can be filtered with "daemon.err"
+// or ".err". Missing parts are skipped, and line breaks within the message escaped.
+func (m *SyslogMessage) appendLine(b []byte) []byte {
+	b = m.time.UTC().AppendFormat(b, INGEST_TIME_FORMAT)
+	b = append(b, ' ')
+	b = append(b, syslogFacilities[m.facility]...)
+	b = append(b, '.')
+	b = append(b, syslogSeverities[m.severity]...)
+	for _, v := range []string{m.host, m.app} {
+		if v != "" {
+			b = append(b, ' ')
+			b = append(b, v...)
+		}
+	}
+	if m.procId != "" {
+		b = append(b, '[')
+		b = append(b, m.procId...)
+		b = append(b, ']')
+	}
+	for _, v := range []string{m.msgId, m.data} {
+		if v != "" {
+			b = append(b, ' ')
+			b = append(b, v...)
+		}
+	}
+	b = append(b, ": "...)
+	b = appendEscapedLine(b, m.msg)
+	return append(b, '\n')
+}
+
+// Appends v, escaping line breaks and invalid UTF-8 so that it stays on a single line.
+func appendEscapedLine(b []byte, v string) []byte {
+	v = strings.TrimRight(v, "\r\n")
+	for len(v) > 0 {
+		r, size := utf8.DecodeRuneInString(v)
+		switch {
+		case r == '\n':
+			b = append(b, `\n`...)
+		case r == '\r':
+			b = append(b, `\r`...)
+		case r == utf8.RuneError && size == 1:
+			b = fmt.Appendf(b, `\x%02x`, v[0])
+		default:
+			b = append(b, v[:size]...)
+		}
+		v = v[size:]
+	}
+	return b
+}
+
+// Receives syslog messages on [IngestConfig.syslog].
+func (cl *CaptureListener) startSyslog() error {
+	addrs, err := parseListenAddresses(cl.g.syslog, false, "udp", "tcp")
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if a.network == "udp" {
+			pc, err := cl.listenPacket(a)
+			if err != nil {
+				return err
+			}
+			cl.readPackets(pc, a, func(p []byte, from net.Addr) {
+				cl.writeSyslog(p[:min(len(p), MAX_SYSLOG_MESSAGE_SIZE)], hostOf(from))
+			})
+		} else {
+			l, err := cl.listen(a)
+			if err != nil {
+				return err
+			}
+			go cl.accept(l, a, cl.serveSyslog)
+		}
+		log.Printf("Receiving syslog messages on %s.", a)
+	}
+	return nil
+}
+
+func (cl *CaptureListener) writeSyslog(p []byte, from string) {
+	m := parseSyslog(p, time.Now(), from)
+	id := m.captureId(cl.g.syslogPartition)
+	if err := cl.write(id, m.appendLine(nil)); err != nil {
+		log.Printf("[%s] Capture error: %+v", from, err)
+	}
+}
+
+// Reads syslog messages from a TCP connection, framed either by octet counting
+// ("<length> <message>", RFC 6587) or by line breaks. Each message may use either.
+func (cl *CaptureListener) serveSyslog(conn net.Conn, a ListenAddress) {
+	peer := peerName(conn, a)
+	from := hostOf(conn.RemoteAddr())
+	r := bufio.NewReaderSize(conn, MAX_SYSLOG_MESSAGE_SIZE)
+	for {
+		msg, err := readSyslogFrame(r)
+		if len(msg) > 0 {
+			cl.writeSyslog(msg, from)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("[%s] Syslog error: %+v", peer, err)
+			return
+		}
+	}
+}
+
+// Reads a message framed by octet counting if it starts with digits
+// followed by a space, or by a line break otherwise.
+func readSyslogFrame(r *bufio.Reader) ([]byte, error) {
+	countLen, err := octetCountLen(r)
+	if err != nil {
+		return nil, err
+	}
+	if countLen > 0 {
+		length, _ := r.Peek(countLen)
+		n, err := strconv.Atoi(string(length[:countLen-1]))
+		if err != nil || n > MAX_SYSLOG_MESSAGE_SIZE {
+			return nil, fmt.Errorf("invalid octet count %q", length)
+		}
+		r.Discard(countLen)
+		msg := make([]byte, n)
+		read, err := io.ReadFull(r, msg)
+		return msg[:read], err
+	}
+	line, err := r.ReadSlice('\n')
+	msg := bytes.Clone(line)
+	// Too long, the rest is dropped.
+	for err == bufio.ErrBufferFull {
+		_, err = r.ReadSlice('\n')
+	}
+	return bytes.Trim(msg, "\x00"), err
+}
+
+// Returns the length of the octet count the input starts with, including
+// the space after it, or 0 if it doesn't start with one.
+func octetCountLen(r *bufio.Reader) (int, error) {
+	for i := 1; ; i++ {
+		b, err := r.Peek(i)
+		if err != nil {
+			if i > 1 {
+				// Digits up to the end of the input or buffer, read as a line.
+				return 0, nil
+			}
+			return 0, err
+		}
+		switch c := b[i-1]; {
+		case c == ' ' && i > 1:
+			return i, nil
+		case c < '0' || c > '9':
+			return 0, nil
+		}
+	}
+}
+
+// Returns the host of addr, without its port.
+func hostOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSyslog(t *testing.T) {
+	local := func(year int, month time.Month, day, hour, min, sec int) time.Time {
+		return time.Date(year, month, day, hour, min, sec, 0, time.Local)
+	}
+	received := local(2024, time.November, 1, 12, 0, 0)
+	tests := []struct {
+		name     string
+		in       string
+		received time.Time
+		want     SyslogMessage
+	}{
+		{"RFC 5424", `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application"] ` + "\ufeffAn application event\n", received,
+			SyslogMessage{facility: 20, severity: 5, time: time.Date(2003, 10, 11, 22, 14, 15, 3e6, time.UTC),
+				host: "mymachine.example.com", app: "evntslog", msgId: "ID47",
+				data: `[exampleSDID@32473 iut="3" eventSource="Application"]`, msg: "An application event"}},
+		{"RFC 5424 with nil values", "<34>1 - - - - - -", received,
+			SyslogMessage{facility: 4, severity: 2, time: received, host: "10.0.0.1"}},
+		{"RFC 5424 with several elements", `<14>1 2024-05-01T12:00:00+02:00 h a 12 - [a x="1\]" y="[2]"][b z="3"] msg`, received,
+			SyslogMessage{facility: 1, severity: 6, time: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+				host: "h", app: "a", procId: "12", data: `[a x="1\]" y="[2]"][b z="3"]`, msg: "msg"}},
+		{"RFC 5424 without message", `<14>1 2024-05-01T12:00:00Z h a - - [a x="1"]`, received,
+			SyslogMessage{facility: 1, severity: 6, time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+				host: "h", app: "a", data: `[a x="1"]`}},
+		{"RFC 3164", "<34>Oct 11 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8", received,
+			SyslogMessage{facility: 4, severity: 2, time: local(2024, time.October, 11, 22, 14, 15),
+				host: "mymachine", app: "su", msg: "'su root' failed for lonvick on /dev/pts/8"}},
+		{"RFC 3164 with a pid", "<13>Feb  5 17:32:18 10.0.0.99 myapp[123]: hello", received,
+			SyslogMessage{facility: 1, severity: 5, time: local(2024, time.February, 5, 17, 32, 18),
+				host: "10.0.0.99", app: "myapp", procId: "123", msg: "hello"}},
+		{"RFC 3164 without a host", "<13>Feb  5 17:32:18 myapp: hello\x00", received,
+			SyslogMessage{facility: 1, severity: 5, time: local(2024, time.February, 5, 17, 32, 18),
+				host: "10.0.0.1", app: "myapp", msg: "hello"}},
+		{"RFC 3164 with an RFC 3339 timestamp", "<13>2024-05-01T12:00:00Z host app: hi\r\n", received,
+			SyslogMessage{facility: 1, severity: 5, time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+				host: "host", app: "app", msg: "hi"}},
+		{"RFC 3164 without a timestamp", "<13>host app: hi", received,
+			SyslogMessage{facility: 1, severity: 5, time: received, host: "host", app: "app", msg: "hi"}},
+		{"RFC 3164 from the previous year", "<13>Dec 31 23:59:50 host app: hi", local(2025, time.January, 1, 0, 0, 10),
+			SyslogMessage{facility: 1, severity: 5, time: local(2024, time.December, 31, 23, 59, 50), host: "host", app: "app", msg: "hi"}},
+		{"RFC 3164 from the next year", "<13>Jan  1 00:00:05 host app: hi", local(2024, time.December, 31, 23, 59, 50),
+			SyslogMessage{facility: 1, severity: 5, time: local(2025, time.January, 1, 0, 0, 5), host: "host", app: "app", msg: "hi"}},
+		{"RFC 3164 on a leap day", "<13>Feb 29 12:00:00 host app: hi", local(2024, time.March, 1, 0, 0, 0),
+			SyslogMessage{facility: 1, severity: 5, time: local(2024, time.February, 29, 12, 0, 0), host: "host", app: "app", msg: "hi"}},
+		{"RFC 3164 on a leap day of the previous year", "<13>Feb 29 12:00:00 host app: hi", local(2025, time.March, 1, 0, 0, 0),
+			SyslogMessage{facility: 1, severity: 5, time: local(2024, time.February, 29, 12, 0, 0), host: "host", app: "app", msg: "hi"}},
+		{"RFC 3164 right before a leap day", "<13>Feb 28 12:00:00 host app: hi", local(2025, time.March, 1, 0, 0, 0),
+			SyslogMessage{facility: 1, severity: 5, time: local(2025, time.February, 28, 12, 0, 0), host: "host", app: "app", msg: "hi"}},
+		{"no priority", "hello world", received,
+			SyslogMessage{facility: 1, severity: 5, time: received, host: "10.0.0.1", msg: "hello world"}},
+		{"invalid priority", "<999>1 - - - - - -", received,
+			SyslogMessage{facility: 1, severity: 5, time: received, host: "10.0.0.1", msg: "<999>1 - - - - - -"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseSyslog([]byte(tt.in), tt.received, "10.0.0.1")
+			if !got.time.Equal(tt.want.time) {
+				t.Errorf("time %v, want %v", got.time, tt.want.time)
+			}
+			got.time, tt.want.time = time.Time{}, time.Time{}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n %+v\nwant\n %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		// Of the reader, the default when zero.
+		size int
+		want []string
+		err  error
+	}{
+		{"line breaks", "<13>a\n<13>b\r\n", 0, []string{"<13>a\n", "<13>b\r\n"}, io.EOF},
+		{"last line unterminated", "<13>a\n<13>b", 0, []string{"<13>a\n", "<13>b"}, io.EOF},
+		{"octet counting", "5 <13>a6 <13>bc", 0, []string{"<13>a", "<13>bc"}, io.EOF},
+		{"octet counting with line breaks", "8 <13>a\nbc5 <13>d", 0, []string{"<13>a\nbc", "<13>d"}, io.EOF},
+		{"mixed framing", "5 <13>a<13>b\n5 <13>c", 0, []string{"<13>a", "<13>b\n", "<13>c"}, io.EOF},
+		{"NUL padding", "\x00<13>a\x00", 0, []string{"<13>a"}, io.EOF},
+		{"line too long", "<13>" + strings.Repeat("x", 30) + "\n<13>b\n", 16, []string{"<13>xxxxxxxxxxxx", "<13>b\n"}, io.EOF},
+		{"octet count truncated", "10 <13>a", 0, []string{"<13>a"}, io.ErrUnexpectedEOF},
+		{"line starting with digits", "12a <13>a\n2024-05-01 <13>b\n5 <13>c", 0,
+			[]string{"12a <13>a\n", "2024-05-01 <13>b\n", "<13>c"}, io.EOF},
+		{"digits alone", "10", 0, []string{"10"}, io.EOF},
+		{"digits up to the end of the buffer", "12345678901234567890 <13>a\n<13>b\n", 16,
+			[]string{"1234567890123456", "<13>b\n"}, io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size := tt.size
+			if size == 0 {
+				size = MAX_SYSLOG_MESSAGE_SIZE
+			}
+			r := bufio.NewReaderSize(strings.NewReader(tt.in), size)
+			var got []string
+			var err error
+			for err == nil {
+				var msg []byte
+				msg, err = readSyslogFrame(r)
+				if len(msg) > 0 {
+					got = append(got, string(msg))
+				}
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("error %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Counts over the limit can't be skipped reliably, dropping the connection.
+func TestReadSyslogFrameInvalidCount(t *testing.T) {
+	for _, in := range []string{"99999999 <13>a", "99999999999999999999999 <13>a"} {
+		r := bufio.NewReader(strings.NewReader(in))
+		if msg, err := readSyslogFrame(r); err == nil || errors.Is(err, io.EOF) {
+			t.Errorf("readSyslogFrame(%q) = %q, %v, want an error", in, msg, err)
+		}
+	}
+}
+
+func TestSyslogMessageAppendLine(t *testing.T) {
+	m := SyslogMessage{facility: 3, severity: 3, time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		host: "h", app: "a", procId: "12", msgId: "ID1", data: `[x y="1"]`, msg: "one\ntwo\xff\n"}
+	want := `2024-05-01T12:00:00.000Z daemon.err h a[12] ID1 [x y="1"]: one\ntwo\xff` + "\n"
+	if got := string(m.appendLine(nil)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	m = SyslogMessage{facility: 1, severity: 5, time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), msg: "hi"}
+	if got, want := string(m.appendLine(nil)), "2024-05-01T12:00:00.000Z user.notice: hi\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSyslogMessageCaptureId(t *testing.T) {
+	m := SyslogMessage{host: "web-1.local", app: "nginx"}
+	for partition, want := range map[string]string{
+		PARTITION_HOST:     "web-1.local",
+		PARTITION_APP:      "nginx",
+		PARTITION_HOST_APP: "web-1.local-nginx",
+	} {
+		if got := m.captureId(partition); got != want {
+			t.Errorf("%s: got %q, want %q", partition, got, want)
+		}
+	}
+	if got, want := (&SyslogMessage{}).captureId(PARTITION_HOST_APP), "unknown-unknown"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSanitizeCaptureId(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"checkout", "checkout"},
+		{"checkout api", "checkout_api"},
+		{"../etc/passwd", "_._etc_passwd"},
+		{"-flag", "_flag"},
+		{"", "unknown"},
+		{strings.Repeat("a", 200), strings.Repeat("a", 128)},
+	}
+	for _, tt := range tests {
+		got := sanitizeCaptureId(tt.in)
+		if got != tt.want {
+			t.Errorf("sanitizeCaptureId(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		if err := validateCaptureId(got); err != nil {
+			t.Errorf("sanitizeCaptureId(%q): %v", tt.in, err)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// What a stream does with new lines when its client falls behind,
+// that is, when [ServerConfig.sendQueue] messages are already waiting.
+const (
+	// Waits for the client, reading the source no faster than it can take.
+	SLOW_CLIENT_BLOCK string = "block"
+	// Skips lines until the queue has room again, then reports
+	// how many were skipped with a [MARKER_DROPPED] frame.
+	SLOW_CLIENT_DROP string = "drop"
+	// Closes the connection.
+	SLOW_CLIENT_DISCONNECT string = "disconnect"
+)
+
+// Returned when a client falls behind under [SLOW_CLIENT_DISCONNECT].
+var errSlowClient = errors.New("client fell behind")
+
+func validateSlowClientPolicy(policy string) error {
+	switch policy {
+	case SLOW_CLIENT_BLOCK, SLOW_CLIENT_DROP, SLOW_CLIENT_DISCONNECT:
+		return nil
+	}
+	return fmt.Errorf("unknown slow client policy %q: must be %q, %q or %q",
+		policy, SLOW_CLIENT_BLOCK, SLOW_CLIENT_DROP, SLOW_CLIENT_DISCONNECT)
+}
+
+// A message waiting to be written by a [StreamWriter].
+type OutMessage struct {
+	t int
+	b []byte
+	// Whether b holds a line, which may share a message with other lines.
+	// Other messages are always written on their own.
+	line bool
+	// Lines dropped right before this one.
+	dropped int
+}
+
+// The only writer of a stream's connection. Lines are queued by the streaming
+// goroutine, and written by [StreamWriter.run] in batches of up to
+// [ServerConfig.batchSize] kilobytes, waiting at most [ServerConfig.batchDelay]
+// for a batch to fill up. The connection is pinged every
+// [ServerConfig.pingInterval] while idle or not.
+type StreamWriter struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	tag    string
+	sr     *ServerResources
+	// The server configuration when the stream started,
+	// kept for the whole stream across reloads.
+	cfg   *ServerConfig
+	conn  *websocket.Conn
+	queue chan OutMessage
+	// Separates lines sharing a message, if their framing needs it.
+	sep []byte
+	// Lines dropped since the last queued line. Taken by the next one, or reported by
+	// [StreamWriter.run] on its own once the queue is empty, so that it isn't held
+	// back until another line comes.
+	dropped atomic.Int64
+	// Lines waiting to be written as a single message, and their message type.
+	// Owned by [StreamWriter.run], then by whoever stopped the writer.
+	batch     []byte
+	batchType int
+	// Closed when [StreamWriter.run] returns, after setting err.
+	done chan struct{}
+	err  error
+}
+
+// Starts writing to conn until ctx is done, which is cancelled
+// in turn if writing fails.
+func newStreamWriter(ctx context.Context, cancel context.CancelCauseFunc, tag string, sr *ServerResources, conn *websocket.Conn, envelope Envelope) *StreamWriter {
+	cfg := sr.config()
+	w := &StreamWriter{
+		ctx:    ctx,
+		cancel: cancel,
+		tag:    tag,
+		sr:     sr,
+		cfg:    cfg,
+		conn:   conn,
+		queue:  make(chan OutMessage, max(cfg.sendQueue, 1)),
+		done:   make(chan struct{}),
+	}
+	if envelope == ENVELOPE_JSON {
+		// Newline-delimited JSON, raw lines carry their own line breaks
+		// and binary envelopes are length-prefixed.
+		w.sep = []byte{'\n'}
+	}
+	go w.run()
+	return w
+}
+
+// Queues a line, applying [ServerConfig.slowClient] if the queue is full.
+// Must only be called from the streaming goroutine.
+func (w *StreamWriter) writeLine(t int, b []byte) error {
+	m := OutMessage{t: t, b: b, line: true}
+	if w.cfg.slowClient == SLOW_CLIENT_BLOCK {
+		return w.write(m)
+	}
+	m.dropped = int(w.dropped.Swap(0))
+	select {
+	case w.queue <- m:
+		return nil
+	case <-w.done:
+		return w.failure()
+	default:
+	}
+	if w.cfg.slowClient == SLOW_CLIENT_DISCONNECT {
+		return errSlowClient
+	}
+	w.dropped.Add(int64(m.dropped) + 1)
+	return nil
+}
+
+// Queues a message, waiting for room in the queue if needed.
+// Must only be called from the streaming goroutine.
+func (w *StreamWriter) write(m OutMessage) error {
+	select {
+	case w.queue <- m:
+		return nil
+	case <-w.done:
+		return w.failure()
+	}
+}
+
+// Why the writer stopped. Only valid once [StreamWriter.done] is closed.
+func (w *StreamWriter) failure() error {
+	if w.err != nil {
+		return w.err
+	}
+	return fmt.Errorf("stream ended: %w", w.ctx.Err())
+}
+
+// Writes whatever is left in the queue and stops the writer.
+// Must only be called from the streaming goroutine, once.
+func (w *StreamWriter) Close() {
+	close(w.queue)
+	<-w.done
+}
+
+// Stops the writer right away, discarding the queue,
+// and closes the connection with a close frame.
+// Must only be called from the streaming goroutine, once.
+func (w *StreamWriter) Abort(code int, text string) {
+	w.cancel(nil)
+	<-w.done
+	w.writeClose(code, text)
+}
+
+// Stops the writer once whatever was already queued is written,
+// then closes the connection with a close frame.
+// Must only be called from the streaming goroutine, once.
+func (w *StreamWriter) Shutdown(code int, text string) {
+	w.cancel(nil)
+	<-w.done
+	if w.err == nil {
+		close(w.queue)
+		err := w.writeBatch()
+		for m := range w.queue {
+			if err != nil {
+				break
+			}
+			if m.dropped > 0 {
+				if err = w.writeDropped(m.dropped); err != nil {
+					break
+				}
+			}
+			if m.line {
+				m.b = escapeControlPrefix(m.t, m.b)
+			}
+			err = w.writeMessage(m.t, m.b)
+		}
+		if err == nil {
+			err = w.writeTrailingDropped()
+		}
+		if err != nil {
+			w.sr.log.Printf("%s Drain error: %+v", w.tag, err)
+		}
+	}
+	w.writeClose(code, text)
+}
+
+func (w *StreamWriter) writeClose(code int, text string) {
+	msg := websocket.FormatCloseMessage(code, text)
+	if err := w.conn.WriteControl(websocket.CloseMessage, msg, w.deadline()); err != nil {
+		w.sr.log.Printf("%s Close error: %+v", w.tag, err)
+	}
+}
+
+func (w *StreamWriter) deadline() time.Time {
+	if w.cfg.writeTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(w.cfg.writeTimeout) * time.Millisecond)
+}
+
+func (w *StreamWriter) run() {
+	defer close(w.done)
+	w.err = w.loop()
+	if w.err != nil {
+		w.cancel(w.err)
+	}
+}
+
+func (w *StreamWriter) loop() error {
+	var ping <-chan time.Time
+	if w.cfg.pingInterval > 0 {
+		t := time.NewTicker(time.Duration(w.cfg.pingInterval) * time.Millisecond)
+		defer t.Stop()
+		ping = t.C
+	}
+	delay := time.NewTimer(time.Hour)
+	delay.Stop()
+	// Nil while the batch is empty.
+	var flush <-chan time.Time
+	writeBatch := func() error {
+		delay.Stop()
+		flush = nil
+		return w.writeBatch()
+	}
+	// Writes the batch, then the lines dropped after it if nothing else is queued.
+	flushBatch := func() error {
+		if err := writeBatch(); err != nil {
+			return err
+		}
+		if len(w.queue) > 0 {
+			return nil
+		}
+		return w.writeTrailingDropped()
+	}
+	for {
+		select {
+		case m, ok := <-w.queue:
+			if !ok {
+				return flushBatch()
+			}
+			if m.dropped > 0 {
+				if err := writeBatch(); err != nil {
+					return err
+				}
+				if err := w.writeDropped(m.dropped); err != nil {
+					return err
+				}
+			}
+			if !m.line || m.t != w.batchType {
+				if err := writeBatch(); err != nil {
+					return err
+				}
+			}
+			if !m.line {
+				if err := w.writeMessage(m.t, m.b); err != nil {
+					return err
+				}
+				continue
+			}
+			if len(w.batch) > 0 {
+				w.batch = append(w.batch, w.sep...)
+			}
+			w.batch = append(w.batch, m.b...)
+			w.batchType = m.t
+			if len(w.batch) >= w.cfg.batchSize<<10 || w.cfg.batchDelay <= 0 && len(w.queue) == 0 {
+				if err := flushBatch(); err != nil {
+					return err
+				}
+			} else if flush == nil {
+				delay.Reset(time.Duration(w.cfg.batchDelay) * time.Millisecond)
+				flush = delay.C
+			}
+		case <-flush:
+			if err := flushBatch(); err != nil {
+				return err
+			}
+		case <-ping:
+			if err := w.conn.WriteControl(websocket.PingMessage, nil, w.deadline()); err != nil {
+				return fmt.Errorf("ping error: %w", err)
+			}
+		case <-w.ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (w *StreamWriter) writeBatch() error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+	b := escapeControlPrefix(w.batchType, w.batch)
+	w.batch = nil
+	return w.writeMessage(w.batchType, b)
+}
+
+// Doubles the [CONTROL_FRAME_PREFIX] of text messages holding lines that start with it,
+// which would otherwise be taken for control frames. Clients drop the first one.
+// Only raw lines may start with it, JSON envelopes start with "{".
+func escapeControlPrefix(t int, b []byte) []byte {
+	if t != websocket.TextMessage || len(b) == 0 || b[0] != CONTROL_FRAME_PREFIX {
+		return b
+	}
+	return append([]byte{CONTROL_FRAME_PREFIX}, b...)
+}
+
+func (w *StreamWriter) writeMessage(t int, b []byte) error {
+	if err := w.conn.SetWriteDeadline(w.deadline()); err != nil {
+		return fmt.Errorf("write error: %w", err)
+	}
+	if err := w.conn.WriteMessage(t, b); err != nil {
+		return fmt.Errorf("write error: %w", err)
+	}
+	return nil
+}
+
+// Reports the lines dropped after the last queued one, if any.
+func (w *StreamWriter) writeTrailingDropped() error {
+	if n := w.dropped.Swap(0); n > 0 {
+		return w.writeDropped(int(n))
+	}
+	return nil
+}
+
+func (w *StreamWriter) writeDropped(n int) error {
+	w.sr.log.Printf("%s Client fell behind, dropped %d lines.", w.tag, n)
+	b, err := encodeFrame(ControlFrame{
+		Type:    FRAME_MARKER,
+		Event:   MARKER_DROPPED,
+		Message: fmt.Sprintf("the client fell behind, %d lines were dropped", n),
+	})
+	if err != nil {
+		return err
+	}
+	return w.writeMessage(websocket.TextMessage, b)
+}